@@ -2,89 +2,254 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"log"
+	"log/slog"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"runtime"
-
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vrtineu/payments-proxy/internal/config"
 	"github.com/vrtineu/payments-proxy/internal/infra/redis"
+	"github.com/vrtineu/payments-proxy/internal/logging"
+	"github.com/vrtineu/payments-proxy/internal/metrics"
 	"github.com/vrtineu/payments-proxy/internal/payments"
 	"github.com/vrtineu/payments-proxy/internal/payments/processor"
+	"github.com/vrtineu/payments-proxy/internal/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 func main() {
+	cfg, opts, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if opts.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	logging.Setup(os.Stderr, cfg.LogConfig())
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if os.Getenv("ENABLE_PPROF") == "true" {
+	if cfg.Server.EnablePprof {
 		go func() {
-			http.ListenAndServe(":6060", nil)
+			http.ListenAndServe(cfg.Server.PprofAddr, nil)
 		}()
 	}
 
-	redisClient := redis.NewRedisClient()
+	shutdownTracing, err := tracing.Setup(ctx, cfg.TracingConfig())
+	if err != nil {
+		slog.Error("setting up tracing", logging.Err(err))
+		os.Exit(1)
+	}
+
+	redisClient := redis.NewRedisClient(cfg.RedisConfig())
+
+	gatewayRegistry, err := processor.NewGatewayRegistry(redisClient.Client, cfg.Gateways, cfg.GatewayOptions())
+	if err != nil {
+		panic(err)
+	}
 
-	defaultGatewayUrl, fallbackGatewayUrl := getGatewayUrls()
-	defaultGateway := processor.NewPaymentGateway(defaultGatewayUrl, payments.Default)
-	fallbackGateway := processor.NewPaymentGateway(fallbackGatewayUrl, payments.Fallback)
+	circuitSync := processor.NewCircuitSync(redisClient.Client, gatewayRegistry)
+	go circuitSync.Run(ctx, cfg.Circuit.SyncInterval)
+
+	latencyPublisher := processor.NewLatencyPublisher(redisClient.Client, gatewayRegistry, processor.InstanceID())
+	go latencyPublisher.Run(ctx, cfg.Latency.PublishInterval)
 
 	healthChecker := processor.NewHealthChecker(
 		redisClient.Client,
-		defaultGateway,
-		fallbackGateway,
+		gatewayRegistry,
+		cfg.HealthCheckerConfig(),
 	)
 	go healthChecker.StartHealthMonitor(ctx)
 
 	paymentsQueue := payments.NewPaymentsQueue(redisClient.Client)
 
-	err := paymentsQueue.SetupPaymentsQueue(ctx)
+	err = paymentsQueue.SetupPaymentsQueue(ctx)
 	if err != nil {
 		panic(err)
 	}
 
 	paymentsStorage := payments.NewPaymentsStorage(redisClient.Client)
-	paymentHandlers := payments.NewPaymentHandlers(paymentsQueue, paymentsStorage)
 
+	err = paymentsStorage.LoadScripts(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	ackMode, err := payments.ParseAckMode(cfg.Ingestion.AckMode)
+	if err != nil {
+		panic(err)
+	}
+
+	// The batcher outlives the HTTP server during shutdown, so it has its own
+	// context.
+	batcherCtx, stopBatcher := context.WithCancel(ctx)
+	defer stopBatcher()
+
+	var enqueuer payments.Enqueuer = paymentsQueue
+	var batcher *payments.EnqueueBatcher
+	if batchSize := cfg.Ingestion.EnqueueBatchSize; batchSize > 1 {
+		batcher = payments.NewEnqueueBatcher(paymentsQueue, batchSize, cfg.Ingestion.EnqueueBatchLinger)
+		go batcher.Start(batcherCtx)
+		enqueuer = batcher
+	}
+
+	idempotencyStore := payments.NewIdempotencyStore(redisClient.Client, cfg.Ingestion.IdempotencyTTL)
+	paymentStatuses := payments.NewPaymentStatusStore(redisClient.Client, cfg.Ingestion.PaymentStatusTTL)
+	paymentHandlers := payments.NewPaymentHandlers(enqueuer, paymentsStorage, idempotencyStore, paymentStatuses, gatewayRegistry.Infos(), ackMode)
+
+	routingPolicy, err := processor.NewRoutingPolicy(cfg.Routing.Policy, cfg.RoutingOptions())
+	if err != nil {
+		panic(err)
+	}
+
+	pendingAttempts := payments.NewPendingAttemptStore(redisClient.Client, cfg.Worker.PendingAttemptTTL)
 	worker := processor.NewPaymentWorker(
 		paymentsQueue,
 		paymentsStorage,
+		paymentStatuses,
+		pendingAttempts,
 		healthChecker,
-		defaultGateway,
-		fallbackGateway,
+		gatewayRegistry,
+		routingPolicy,
+		cfg.WorkerOptions(),
 	)
+	go worker.RunRetryPromoter(ctx, cfg.Worker.RetryPromoteInterval)
 
-	numWorkers := runtime.NumCPU()
-	if numWorkers < 2 {
-		numWorkers = 2
-	}
-	if numWorkers > 8 {
-		numWorkers = 8
-	}
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
 
-	for i := 0; i < numWorkers; i++ {
-		go worker.Start(ctx)
+	var workers sync.WaitGroup
+	for range cfg.WorkerCount() {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			worker.Start(workerCtx)
+		}()
 	}
 
+	var draining atomic.Bool
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("DRAINING"))
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
-	http.HandleFunc("/payments", paymentHandlers.CreatePaymentHandler)
+	prometheus.MustRegister(
+		payments.NewQueueCollector(paymentsQueue),
+		processor.NewGatewayCollector(gatewayRegistry, healthChecker),
+	)
+
+	http.Handle("/payments", otelhttp.NewHandler(
+		metrics.InstrumentPayments(http.HandlerFunc(paymentHandlers.CreatePaymentHandler)),
+		"POST /payments",
+	))
+	http.HandleFunc("/payments/{correlationId}", paymentHandlers.PaymentStatusHandler)
 	http.HandleFunc("/payments-summary", paymentHandlers.PaymentsSummaryHandler)
+	http.HandleFunc("/gateways/health", healthChecker.HealthReportHandler)
+	http.Handle("/metrics", metrics.Handler())
 
-	http.ListenAndServe(":9999", nil)
-}
+	server := &http.Server{Addr: cfg.Server.Addr}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	signals, stopSignals := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer stopSignals()
+	<-signals.Done()
+
+	slog.Info("shutting down, draining in-flight work")
+	draining.Store(true)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(ctx, cfg.Server.ShutdownTimeout)
+	defer cancelShutdown()
+
+	// Claimed messages are finished while the load balancer notices the failing
+	// health check; new ones are left for the other instances.
+	stopWorkers()
+	sleepContext(shutdownCtx, cfg.Server.DrainDelay)
 
-func getGatewayUrls() (defaultGatewayUrl, fallbackGatewayUrl string) {
-	defaultGatewayUrl = os.Getenv("DEFAULT_GATEWAY_URL")
-	if defaultGatewayUrl == "" {
-		defaultGatewayUrl = "http://localhost:8001"
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("shutting down HTTP server", logging.Err(err))
 	}
 
-	fallbackGatewayUrl = os.Getenv("FALLBACK_GATEWAY_URL")
-	if fallbackGatewayUrl == "" {
-		fallbackGatewayUrl = "http://localhost:8082"
+	if err := paymentHandlers.Wait(shutdownCtx); err != nil {
+		slog.Error("waiting for pending enqueues", logging.Err(err))
 	}
 
-	return
+	stopBatcher()
+	if batcher != nil {
+		select {
+		case <-batcher.Done():
+		case <-shutdownCtx.Done():
+			slog.Warn("timed out flushing enqueue batches")
+		}
+	}
+
+	if !waitGroupContext(shutdownCtx, &workers) {
+		slog.Warn("timed out draining workers, aborting in-flight payments")
+		worker.Abort()
+
+		abortCtx, cancelAbort := context.WithTimeout(ctx, time.Second)
+		defer cancelAbort()
+		waitGroupContext(abortCtx, &workers)
+	}
+
+	// Spans of the payments finished while draining are flushed last.
+	flushCtx, cancelFlush := context.WithTimeout(ctx, time.Second)
+	defer cancelFlush()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("flushing traces", logging.Err(err))
+	}
+
+	slog.Info("shutdown complete")
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// waitGroupContext reports whether wg finished before ctx was done.
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
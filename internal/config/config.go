@@ -0,0 +1,446 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/vrtineu/payments-proxy/internal/infra/redis"
+	"github.com/vrtineu/payments-proxy/internal/logging"
+	"github.com/vrtineu/payments-proxy/internal/payments"
+	"github.com/vrtineu/payments-proxy/internal/payments/processor"
+	"github.com/vrtineu/payments-proxy/internal/tracing"
+)
+
+// Config holds every setting of the server. Each leaf is read, in increasing
+// order of precedence, from its default, the config file, the environment
+// variable named by its env tag and the flag derived from that name
+// (REDIS_ADDR becomes --redis-addr).
+type Config struct {
+	Server   ServerConfig              `yaml:"server"`
+	Redis    RedisConfig               `yaml:"redis"`
+	Gateways []processor.GatewayConfig `yaml:"gateways" env:"GATEWAYS" desc:"gateway registry as a JSON array"`
+	// The default/fallback pair is built from these URLs when no gateway is
+	// configured.
+	DefaultGatewayURL  string              `yaml:"defaultGatewayUrl" env:"DEFAULT_GATEWAY_URL" desc:"URL of the default gateway when gateways is empty"`
+	FallbackGatewayURL string              `yaml:"fallbackGatewayUrl" env:"FALLBACK_GATEWAY_URL" desc:"URL of the fallback gateway when gateways is empty"`
+	GatewayClient      GatewayClientConfig `yaml:"gatewayClient"`
+	Ingestion          IngestionConfig     `yaml:"ingestion"`
+	Worker             WorkerConfig        `yaml:"worker"`
+	Routing            RoutingConfig       `yaml:"routing"`
+	Circuit            CircuitConfig       `yaml:"circuit"`
+	Concurrency        ConcurrencyConfig   `yaml:"concurrency"`
+	Health             HealthConfig        `yaml:"health"`
+	Latency            LatencyConfig       `yaml:"latency"`
+	Tracing            TracingConfig       `yaml:"tracing"`
+	Log                LogConfig           `yaml:"log"`
+}
+
+type ServerConfig struct {
+	Addr            string        `yaml:"addr" env:"SERVER_ADDR" desc:"address the HTTP server listens on"`
+	EnablePprof     bool          `yaml:"enablePprof" env:"ENABLE_PPROF" desc:"serve pprof on pprofAddr"`
+	PprofAddr       string        `yaml:"pprofAddr" env:"PPROF_ADDR" desc:"address of the pprof listener"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT" desc:"deadline to drain the instance after SIGTERM"`
+	DrainDelay      time.Duration `yaml:"drainDelay" env:"SHUTDOWN_DRAIN_DELAY" desc:"time the load balancer gets to notice the failing health check"`
+}
+
+type RedisConfig struct {
+	Addr         string        `yaml:"addr" env:"REDIS_ADDR" desc:"Redis address"`
+	PoolSize     int           `yaml:"poolSize" env:"REDIS_POOL_SIZE" desc:"Redis connection pool size"`
+	MinIdleConns int           `yaml:"minIdleConns" env:"REDIS_MIN_IDLE_CONNS" desc:"Redis idle connections kept open"`
+	PoolTimeout  time.Duration `yaml:"poolTimeout" env:"REDIS_POOL_TIMEOUT" desc:"wait for a free Redis connection"`
+}
+
+type GatewayClientConfig struct {
+	Timeout         time.Duration `yaml:"timeout" env:"GATEWAY_TIMEOUT" desc:"timeout of each gateway HTTP call"`
+	MaxIdleConns    int           `yaml:"maxIdleConns" env:"GATEWAY_MAX_IDLE_CONNS" desc:"idle connections kept per gateway client"`
+	IdleConnTimeout time.Duration `yaml:"idleConnTimeout" env:"GATEWAY_IDLE_CONN_TIMEOUT" desc:"how long idle gateway connections are kept"`
+}
+
+type IngestionConfig struct {
+	AckMode            string        `yaml:"ackMode" env:"ACK_MODE" desc:"async or durable"`
+	EnqueueBatchSize   int           `yaml:"enqueueBatchSize" env:"ENQUEUE_BATCH_SIZE" desc:"enqueues pipelined together, 0 or 1 disables batching"`
+	EnqueueBatchLinger time.Duration `yaml:"enqueueBatchLinger" env:"ENQUEUE_BATCH_LINGER" desc:"wait for a batch to fill"`
+	IdempotencyTTL     time.Duration `yaml:"idempotencyTtl" env:"IDEMPOTENCY_TTL" desc:"how long correlation ids are remembered"`
+	PaymentStatusTTL   time.Duration `yaml:"paymentStatusTtl" env:"PAYMENT_STATUS_TTL" desc:"how long payment statuses are kept"`
+}
+
+type WorkerConfig struct {
+	Count                int           `yaml:"count" env:"WORKER_COUNT" desc:"stream consumers per instance, 0 picks one per CPU between 2 and 8"`
+	MaxDeliveryAttempts  int64         `yaml:"maxDeliveryAttempts" env:"MAX_DELIVERY_ATTEMPTS" desc:"processor calls before dead-lettering, 0 retries forever"`
+	RetryBaseDelay       time.Duration `yaml:"retryBaseDelay" env:"RETRY_BASE_DELAY" desc:"delay of the first retry"`
+	RetryMaxDelay        time.Duration `yaml:"retryMaxDelay" env:"RETRY_MAX_DELAY" desc:"maximum delay between retries"`
+	RetryPromoteInterval time.Duration `yaml:"retryPromoteInterval" env:"RETRY_PROMOTE_INTERVAL" desc:"how often due retries return to the stream"`
+	PendingAttemptTTL    time.Duration `yaml:"pendingAttemptTtl" env:"PENDING_ATTEMPT_TTL" desc:"how long the gateway of an unconfirmed attempt is remembered"`
+	ClaimMinIdle         time.Duration `yaml:"claimMinIdle" env:"CLAIM_MIN_IDLE" desc:"idle time after which another consumer claims a message"`
+	MaxLimitWait         time.Duration `yaml:"maxLimitWait" env:"MAX_LIMIT_WAIT" desc:"longest wait for a gateway's rate and concurrency limits before the attempt is retried later"`
+}
+
+type RoutingConfig struct {
+	Policy          string         `yaml:"policy" env:"ROUTING_POLICY" desc:"sticky, cost, latency or weighted"`
+	Weights         map[string]int `yaml:"weights" env:"ROUTING_WEIGHTS" desc:"weights of the weighted policy, e.g. default=80,fallback=20"`
+	SwitchAbove     time.Duration  `yaml:"switchAbove" env:"ROUTING_SWITCH_ABOVE" desc:"latency above which the sticky policy switches"`
+	SwitchBackBelow time.Duration  `yaml:"switchBackBelow" env:"ROUTING_SWITCH_BACK_BELOW" desc:"latency below which the sticky policy switches back"`
+}
+
+type CircuitConfig struct {
+	Window         time.Duration `yaml:"window" env:"CIRCUIT_WINDOW" desc:"window over which call outcomes are counted"`
+	MinRequests    int64         `yaml:"minRequests" env:"CIRCUIT_MIN_REQUESTS" desc:"calls needed in the window before opening"`
+	ErrorRate      float64       `yaml:"errorRate" env:"CIRCUIT_ERROR_RATE" desc:"fraction of failed calls that opens the circuit"`
+	SlowCall       time.Duration `yaml:"slowCall" env:"CIRCUIT_SLOW_CALL" desc:"latency from which a call counts as slow"`
+	SlowCallRate   float64       `yaml:"slowCallRate" env:"CIRCUIT_SLOW_CALL_RATE" desc:"fraction of slow calls that opens the circuit"`
+	OpenDuration   time.Duration `yaml:"openDuration" env:"CIRCUIT_OPEN_DURATION" desc:"how long the circuit stays open"`
+	HalfOpenTrials int64         `yaml:"halfOpenTrials" env:"CIRCUIT_HALF_OPEN_TRIALS" desc:"trial calls made while half-open"`
+	SyncInterval   time.Duration `yaml:"syncInterval" env:"CIRCUIT_SYNC_INTERVAL" desc:"how often open circuits are shared"`
+}
+
+type ConcurrencyConfig struct {
+	Initial   int     `yaml:"initial" env:"CONCURRENCY_INITIAL" desc:"initial in-flight calls per gateway"`
+	Min       int     `yaml:"min" env:"CONCURRENCY_MIN" desc:"minimum in-flight calls per gateway"`
+	Max       int     `yaml:"max" env:"CONCURRENCY_MAX" desc:"maximum in-flight calls per gateway"`
+	Tolerance float64 `yaml:"tolerance" env:"CONCURRENCY_TOLERANCE" desc:"latency ratio over the baseline tolerated before backing off"`
+	Backoff   float64 `yaml:"backoff" env:"CONCURRENCY_BACKOFF" desc:"fraction of the limit kept after a failure"`
+}
+
+type HealthConfig struct {
+	Interval      time.Duration `yaml:"interval" env:"HEALTH_CHECK_INTERVAL" desc:"how often health leases are attempted"`
+	LeaseDuration time.Duration `yaml:"leaseDuration" env:"HEALTH_LEASE_DURATION" desc:"minimum time between checks of a gateway"`
+	StatusTTL     time.Duration `yaml:"statusTtl" env:"HEALTH_STATUS_TTL" desc:"how long a status is kept in Redis"`
+	StaleAfter    time.Duration `yaml:"staleAfter" env:"HEALTH_STALE_AFTER" desc:"age from which a status is unknown"`
+	StalePolicy   string        `yaml:"stalePolicy" env:"HEALTH_STALE_POLICY" desc:"failing, healthy or keep"`
+	HistorySize   int           `yaml:"historySize" env:"HEALTH_HISTORY_SIZE" desc:"health transitions kept per gateway"`
+}
+
+type LatencyConfig struct {
+	PublishInterval time.Duration `yaml:"publishInterval" env:"LATENCY_PUBLISH_INTERVAL" desc:"how often latency histograms are shared"`
+}
+
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" env:"TRACING_EXPORTER" desc:"none, stdout or otlp"`
+	Endpoint    string  `yaml:"endpoint" env:"TRACING_ENDPOINT" desc:"OTLP/HTTP endpoint URL, empty uses the OTEL_EXPORTER_OTLP_* variables"`
+	ServiceName string  `yaml:"serviceName" env:"TRACING_SERVICE_NAME" desc:"service name reported on spans"`
+	SampleRatio float64 `yaml:"sampleRatio" env:"TRACING_SAMPLE_RATIO" desc:"fraction of new traces recorded"`
+}
+
+type LogConfig struct {
+	Level            string `yaml:"level" env:"LOG_LEVEL" desc:"debug, info, warn or error"`
+	Format           string `yaml:"format" env:"LOG_FORMAT" desc:"text or json"`
+	SampleInitial    int    `yaml:"sampleInitial" env:"LOG_SAMPLE_INITIAL" desc:"records with the same message written per second before sampling"`
+	SampleThereafter int    `yaml:"sampleThereafter" env:"LOG_SAMPLE_THEREAFTER" desc:"one in this many records written after sampleInitial, 0 disables sampling"`
+}
+
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:            ":9999",
+			PprofAddr:       ":6060",
+			ShutdownTimeout: 15 * time.Second,
+			DrainDelay:      5 * time.Second,
+		},
+		Redis: RedisConfig{
+			Addr:         "localhost:6379",
+			PoolSize:     32,
+			MinIdleConns: 8,
+			PoolTimeout:  time.Second,
+		},
+		DefaultGatewayURL:  "http://localhost:8001",
+		FallbackGatewayURL: "http://localhost:8082",
+		GatewayClient: GatewayClientConfig{
+			Timeout:         10 * time.Second,
+			MaxIdleConns:    256,
+			IdleConnTimeout: 30 * time.Second,
+		},
+		Ingestion: IngestionConfig{
+			AckMode:            "async",
+			EnqueueBatchLinger: time.Millisecond,
+			IdempotencyTTL:     24 * time.Hour,
+			PaymentStatusTTL:   24 * time.Hour,
+		},
+		Worker: WorkerConfig{
+			MaxDeliveryAttempts:  20,
+			RetryBaseDelay:       200 * time.Millisecond,
+			RetryMaxDelay:        30 * time.Second,
+			RetryPromoteInterval: 100 * time.Millisecond,
+			PendingAttemptTTL:    24 * time.Hour,
+			ClaimMinIdle:         30 * time.Second,
+			MaxLimitWait:         2 * time.Second,
+		},
+		Routing: RoutingConfig{
+			Policy:          "sticky",
+			Weights:         map[string]int{},
+			SwitchAbove:     2 * time.Second,
+			SwitchBackBelow: 1500 * time.Millisecond,
+		},
+		Circuit: CircuitConfig{
+			Window:         5 * time.Second,
+			MinRequests:    20,
+			ErrorRate:      0.5,
+			SlowCall:       3 * time.Second,
+			SlowCallRate:   0.8,
+			OpenDuration:   2 * time.Second,
+			HalfOpenTrials: 3,
+			SyncInterval:   100 * time.Millisecond,
+		},
+		Concurrency: ConcurrencyConfig{
+			Initial:   32,
+			Min:       4,
+			Max:       128,
+			Tolerance: 1.5,
+			Backoff:   0.9,
+		},
+		Health: HealthConfig{
+			Interval:      time.Second,
+			LeaseDuration: 6 * time.Second,
+			StatusTTL:     15 * time.Second,
+			StaleAfter:    15 * time.Second,
+			StalePolicy:   "failing",
+			HistorySize:   50,
+		},
+		Latency: LatencyConfig{
+			PublishInterval: time.Second,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			ServiceName: "payments-proxy",
+			SampleRatio: 1,
+		},
+		Log: LogConfig{
+			Level:            "info",
+			Format:           "text",
+			SampleInitial:    20,
+			SampleThereafter: 100,
+		},
+	}
+}
+
+// resolveGateways fills the registry with the legacy default/fallback pair when
+// no gateway was configured.
+func (c *Config) resolveGateways() {
+	if len(c.Gateways) > 0 {
+		return
+	}
+
+	c.Gateways = []processor.GatewayConfig{
+		{Name: payments.Default.String(), URL: c.DefaultGatewayURL, Priority: 0, Fee: payments.MustParseFeeRate("0.05")},
+		{Name: payments.Fallback.String(), URL: c.FallbackGatewayURL, Priority: 1, Fee: payments.MustParseFeeRate("0.15")},
+	}
+}
+
+// Validate reports every invalid setting at once, naming them by their path in
+// the config file.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, field, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr", "must not be empty")
+	check(!c.Server.EnablePprof || c.Server.PprofAddr != "", "server.pprofAddr", "must not be empty when pprof is enabled")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdownTimeout", "must be positive")
+	check(c.Server.DrainDelay >= 0, "server.drainDelay", "must not be negative")
+
+	check(c.Redis.Addr != "", "redis.addr", "must not be empty")
+	check(c.Redis.PoolSize > 0, "redis.poolSize", "must be positive")
+	check(c.Redis.MinIdleConns >= 0 && c.Redis.MinIdleConns <= c.Redis.PoolSize, "redis.minIdleConns", "must be between 0 and poolSize")
+	check(c.Redis.PoolTimeout > 0, "redis.poolTimeout", "must be positive")
+
+	check(len(c.Gateways) > 0, "gateways", "at least one gateway must be configured")
+	names := make(map[string]bool, len(c.Gateways))
+	for i, gateway := range c.Gateways {
+		field := fmt.Sprintf("gateways[%d].name", i)
+		switch {
+		case gateway.Name == "":
+			check(false, field, "must not be empty")
+		case !processor.IsValidGatewayName(gateway.Name):
+			check(false, field, "%q must only have lowercase letters, digits, '-' or '_'", gateway.Name)
+		case names[gateway.Name]:
+			check(false, field, "%q is configured more than once", gateway.Name)
+		}
+		names[gateway.Name] = true
+		check(gateway.URL != "", fmt.Sprintf("gateways[%d].url", i), "must not be empty")
+		check(gateway.RateLimit >= 0 && gateway.Burst >= 0, fmt.Sprintf("gateways[%d].rateLimit", i), "must not be negative")
+	}
+
+	check(c.GatewayClient.Timeout > 0, "gatewayClient.timeout", "must be positive")
+	check(c.GatewayClient.MaxIdleConns > 0, "gatewayClient.maxIdleConns", "must be positive")
+	check(c.GatewayClient.IdleConnTimeout > 0, "gatewayClient.idleConnTimeout", "must be positive")
+
+	_, err := payments.ParseAckMode(c.Ingestion.AckMode)
+	check(err == nil, "ingestion.ackMode", "%v", err)
+	check(c.Ingestion.EnqueueBatchSize >= 0, "ingestion.enqueueBatchSize", "must not be negative")
+	check(c.Ingestion.EnqueueBatchSize <= 1 || c.Ingestion.EnqueueBatchLinger > 0, "ingestion.enqueueBatchLinger", "must be positive when batching is enabled")
+	check(c.Ingestion.IdempotencyTTL > 0, "ingestion.idempotencyTtl", "must be positive")
+	check(c.Ingestion.PaymentStatusTTL > 0, "ingestion.paymentStatusTtl", "must be positive")
+
+	check(c.Worker.Count >= 0, "worker.count", "must not be negative")
+	check(c.Worker.MaxDeliveryAttempts >= 0, "worker.maxDeliveryAttempts", "must not be negative")
+	check(c.Worker.RetryBaseDelay > 0, "worker.retryBaseDelay", "must be positive")
+	check(c.Worker.RetryMaxDelay >= c.Worker.RetryBaseDelay, "worker.retryMaxDelay", "must not be below retryBaseDelay")
+	check(c.Worker.RetryPromoteInterval > 0, "worker.retryPromoteInterval", "must be positive")
+	check(c.Worker.PendingAttemptTTL > 0, "worker.pendingAttemptTtl", "must be positive")
+	check(c.Worker.MaxLimitWait > 0, "worker.maxLimitWait", "must be positive")
+	// A message is only claimed by another consumer once its current owner is
+	// surely done with it: a lookup of the pending attempt, the wait for the
+	// limits and the call itself.
+	check(c.Worker.ClaimMinIdle > 2*c.GatewayClient.Timeout+c.Worker.MaxLimitWait, "worker.claimMinIdle",
+		"must be above twice gatewayClient.timeout plus worker.maxLimitWait")
+
+	_, err = processor.NewRoutingPolicy(c.Routing.Policy, c.RoutingOptions())
+	check(err == nil, "routing.policy", "%v", err)
+	for name, weight := range c.Routing.Weights {
+		check(weight >= 0, "routing.weights."+name, "must not be negative")
+	}
+	check(c.Routing.SwitchAbove > 0, "routing.switchAbove", "must be positive")
+	check(c.Routing.SwitchBackBelow > 0, "routing.switchBackBelow", "must be positive")
+
+	check(c.Circuit.Window > 0, "circuit.window", "must be positive")
+	check(c.Circuit.MinRequests > 0, "circuit.minRequests", "must be positive")
+	check(c.Circuit.ErrorRate > 0 && c.Circuit.ErrorRate <= 1, "circuit.errorRate", "must be in (0, 1]")
+	check(c.Circuit.SlowCall >= 0, "circuit.slowCall", "must not be negative")
+	check(c.Circuit.SlowCallRate > 0 && c.Circuit.SlowCallRate <= 1, "circuit.slowCallRate", "must be in (0, 1]")
+	check(c.Circuit.OpenDuration > 0, "circuit.openDuration", "must be positive")
+	check(c.Circuit.HalfOpenTrials > 0, "circuit.halfOpenTrials", "must be positive")
+	check(c.Circuit.SyncInterval > 0, "circuit.syncInterval", "must be positive")
+
+	check(c.Concurrency.Min > 0, "concurrency.min", "must be positive")
+	check(c.Concurrency.Max >= c.Concurrency.Min, "concurrency.max", "must not be below min")
+	check(c.Concurrency.Initial >= c.Concurrency.Min && c.Concurrency.Initial <= c.Concurrency.Max, "concurrency.initial", "must be between min and max")
+	check(c.Concurrency.Tolerance >= 1, "concurrency.tolerance", "must be at least 1")
+	check(c.Concurrency.Backoff > 0 && c.Concurrency.Backoff < 1, "concurrency.backoff", "must be in (0, 1)")
+
+	check(c.Health.Interval > 0, "health.interval", "must be positive")
+	check(c.Health.LeaseDuration >= processor.HealthCheckRateLimit, "health.leaseDuration", "must be at least %s, the processors' health check rate limit", processor.HealthCheckRateLimit)
+	check(c.Health.StatusTTL > 0, "health.statusTtl", "must be positive")
+	check(c.Health.StaleAfter > 0, "health.staleAfter", "must be positive")
+	_, err = processor.ParseStalePolicy(c.Health.StalePolicy)
+	check(err == nil, "health.stalePolicy", "%v", err)
+	check(c.Health.HistorySize >= 0, "health.historySize", "must not be negative")
+
+	check(c.Latency.PublishInterval > 0, "latency.publishInterval", "must be positive")
+
+	_, err = tracing.ParseExporter(c.Tracing.Exporter)
+	check(err == nil, "tracing.exporter", "%v", err)
+	check(c.Tracing.ServiceName != "", "tracing.serviceName", "must not be empty")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sampleRatio", "must be in [0, 1]")
+
+	_, err = logging.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level", "%v", err)
+	_, err = logging.ParseFormat(c.Log.Format)
+	check(err == nil, "log.format", "%v", err)
+	check(c.Log.SampleInitial >= 0, "log.sampleInitial", "must not be negative")
+	check(c.Log.SampleThereafter >= 0, "log.sampleThereafter", "must not be negative")
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) RedisConfig() redis.Config {
+	return redis.Config{
+		Addr:         c.Redis.Addr,
+		PoolSize:     c.Redis.PoolSize,
+		MinIdleConns: c.Redis.MinIdleConns,
+		PoolTimeout:  c.Redis.PoolTimeout,
+	}
+}
+
+func (c *Config) GatewayOptions() processor.GatewayOptions {
+	return processor.GatewayOptions{
+		Circuit: processor.CircuitBreakerConfig{
+			Window:         c.Circuit.Window,
+			MinRequests:    c.Circuit.MinRequests,
+			ErrorRate:      c.Circuit.ErrorRate,
+			SlowCall:       c.Circuit.SlowCall,
+			SlowCallRate:   c.Circuit.SlowCallRate,
+			OpenDuration:   c.Circuit.OpenDuration,
+			HalfOpenTrials: c.Circuit.HalfOpenTrials,
+		},
+		Concurrency: processor.ConcurrencyConfig{
+			Initial:   c.Concurrency.Initial,
+			Min:       c.Concurrency.Min,
+			Max:       c.Concurrency.Max,
+			Tolerance: c.Concurrency.Tolerance,
+			Backoff:   c.Concurrency.Backoff,
+		},
+		Client: processor.HTTPClientConfig{
+			Timeout:         c.GatewayClient.Timeout,
+			MaxIdleConns:    c.GatewayClient.MaxIdleConns,
+			IdleConnTimeout: c.GatewayClient.IdleConnTimeout,
+		},
+	}
+}
+
+func (c *Config) RoutingOptions() processor.RoutingOptions {
+	return processor.RoutingOptions{
+		Weights:         c.Routing.Weights,
+		SwitchAbove:     c.Routing.SwitchAbove,
+		SwitchBackBelow: c.Routing.SwitchBackBelow,
+	}
+}
+
+// HealthCheckerConfig must only be called on a validated config.
+func (c *Config) HealthCheckerConfig() processor.HealthCheckerConfig {
+	stalePolicy, _ := processor.ParseStalePolicy(c.Health.StalePolicy)
+
+	return processor.HealthCheckerConfig{
+		Interval:      c.Health.Interval,
+		LeaseDuration: c.Health.LeaseDuration,
+		StatusTTL:     c.Health.StatusTTL,
+		StaleAfter:    c.Health.StaleAfter,
+		StalePolicy:   stalePolicy,
+		HistorySize:   c.Health.HistorySize,
+	}
+}
+
+func (c *Config) WorkerOptions() processor.WorkerOptions {
+	return processor.WorkerOptions{
+		RetryPolicy:  c.RetryPolicy(),
+		ClaimMinIdle: c.Worker.ClaimMinIdle,
+		MaxLimitWait: c.Worker.MaxLimitWait,
+	}
+}
+
+func (c *Config) RetryPolicy() processor.RetryPolicy {
+	return processor.RetryPolicy{
+		MaxAttempts: c.Worker.MaxDeliveryAttempts,
+		BaseDelay:   c.Worker.RetryBaseDelay,
+		MaxDelay:    c.Worker.RetryMaxDelay,
+	}
+}
+
+// TracingConfig must only be called on a validated config.
+func (c *Config) TracingConfig() tracing.Config {
+	exporter, _ := tracing.ParseExporter(c.Tracing.Exporter)
+
+	return tracing.Config{
+		Exporter:    exporter,
+		Endpoint:    c.Tracing.Endpoint,
+		ServiceName: c.Tracing.ServiceName,
+		InstanceID:  processor.InstanceID(),
+		SampleRatio: c.Tracing.SampleRatio,
+	}
+}
+
+// LogConfig must only be called on a validated config.
+func (c *Config) LogConfig() logging.Config {
+	level, _ := logging.ParseLevel(c.Log.Level)
+	format, _ := logging.ParseFormat(c.Log.Format)
+
+	return logging.Config{
+		Level:            level,
+		Format:           format,
+		InstanceID:       processor.InstanceID(),
+		SampleInitial:    c.Log.SampleInitial,
+		SampleThereafter: c.Log.SampleThereafter,
+	}
+}
+
+// WorkerCount resolves a count of 0 to one consumer per CPU, between 2 and 8.
+func (c *Config) WorkerCount() int {
+	if c.Worker.Count > 0 {
+		return c.Worker.Count
+	}
+
+	return min(max(runtime.NumCPU(), 2), 8)
+}
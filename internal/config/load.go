@@ -0,0 +1,235 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vrtineu/payments-proxy/internal/payments/processor"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileEnv names the config file when --config is not given.
+const ConfigFileEnv = "CONFIG_FILE"
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	gatewaysType = reflect.TypeOf([]processor.GatewayConfig(nil))
+	weightsType  = reflect.TypeOf(map[string]int(nil))
+)
+
+// setting is a leaf of Config that can be set from the environment or a flag.
+type setting struct {
+	env   string
+	flag  string
+	desc  string
+	value reflect.Value
+}
+
+// Options are the command line switches that are not settings themselves.
+type Options struct {
+	ConfigFile  string
+	PrintConfig bool
+}
+
+// Load builds the configuration from the defaults, the config file, the
+// environment and the command line arguments, in that order of precedence, and
+// validates the result.
+func Load(args []string) (*Config, Options, error) {
+	cfg := Default()
+	settings := collectSettings(reflect.ValueOf(cfg).Elem())
+
+	var opts Options
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.StringVar(&opts.ConfigFile, "config", os.Getenv(ConfigFileEnv), "path of a YAML config file (env "+ConfigFileEnv+")")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective configuration as YAML and exit")
+
+	flagValues := make(map[string]string)
+	for _, s := range settings {
+		fs.Func(s.flag, fmt.Sprintf("%s (env %s, default %s)", s.desc, s.env, formatValue(s.value)), func(value string) error {
+			flagValues[s.flag] = value
+			return nil
+		})
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, opts, err
+	}
+
+	if opts.ConfigFile != "" {
+		if err := loadFile(cfg, opts.ConfigFile); err != nil {
+			return nil, opts, err
+		}
+	}
+
+	for _, s := range settings {
+		if value := os.Getenv(s.env); value != "" {
+			if err := setValue(s.value, value); err != nil {
+				return nil, opts, fmt.Errorf("invalid %s: %w", s.env, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := flagValues[s.flag]; ok {
+			if err := setValue(s.value, value); err != nil {
+				return nil, opts, fmt.Errorf("invalid --%s: %w", s.flag, err)
+			}
+		}
+	}
+
+	cfg.resolveGateways()
+
+	if err := cfg.Validate(); err != nil {
+		return nil, opts, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	return cfg, opts, nil
+}
+
+// Print writes the configuration in the config file format.
+func (c *Config) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
+
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func collectSettings(v reflect.Value) []setting {
+	var settings []setting
+
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+
+		env := field.Tag.Get("env")
+		if env == "" {
+			if field.Type.Kind() == reflect.Struct {
+				settings = append(settings, collectSettings(v.Field(i))...)
+			}
+			continue
+		}
+
+		settings = append(settings, setting{
+			env:   env,
+			flag:  strings.ReplaceAll(strings.ToLower(env), "_", "-"),
+			desc:  field.Tag.Get("desc"),
+			value: v.Field(i),
+		})
+	}
+
+	return settings
+}
+
+func setValue(v reflect.Value, value string) error {
+	switch v.Type() {
+	case durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	case gatewaysType:
+		gateways, err := processor.ParseGatewayConfigs(value)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(gateways))
+		return nil
+	case weightsType:
+		weights, err := parseWeights(value)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(weights))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+
+	return nil
+}
+
+// parseWeights reads weights in the "default=80,fallback=20" form.
+func parseWeights(value string) (map[string]int, error) {
+	weights := make(map[string]int)
+
+	for _, pair := range strings.Split(value, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("weight %q is not in the name=weight form", pair)
+		}
+
+		n, err := strconv.Atoi(weight)
+		if err != nil {
+			return nil, fmt.Errorf("weight of %q: %w", name, err)
+		}
+		weights[name] = n
+	}
+
+	return weights, nil
+}
+
+func formatValue(v reflect.Value) string {
+	switch v.Type() {
+	case durationType:
+		return time.Duration(v.Int()).String()
+	case gatewaysType:
+		return "[]"
+	case weightsType:
+		return "none"
+	}
+
+	if v.Kind() == reflect.String {
+		return strconv.Quote(v.String())
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -1,7 +1,6 @@
 package redis
 
 import (
-	"os"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -11,17 +10,19 @@ type RedisClient struct {
 	Client *redis.Client
 }
 
-func NewRedisClient() *RedisClient {
-	addr := os.Getenv("REDIS_ADDR")
-	if addr == "" {
-		addr = "localhost:6379"
-	}
+type Config struct {
+	Addr         string
+	PoolSize     int
+	MinIdleConns int
+	PoolTimeout  time.Duration
+}
 
+func NewRedisClient(config Config) *RedisClient {
 	rdb := redis.NewClient(&redis.Options{
-		Addr:         addr,
-		PoolSize:     32,
-		MinIdleConns: 8,
-		PoolTimeout:  1 * time.Second,
+		Addr:         config.Addr,
+		PoolSize:     config.PoolSize,
+		MinIdleConns: config.MinIdleConns,
+		PoolTimeout:  config.PoolTimeout,
 	})
 
 	return &RedisClient{
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Keys of the attributes that identify a payment across the log records of
+// the ingestion and processing sides.
+const (
+	CorrelationIDKey = "correlationId"
+	MessageIDKey     = "messageId"
+	GatewayKey       = "gateway"
+	InstanceIDKey    = "instanceId"
+	TraceIDKey       = "traceId"
+	ErrorKey         = "error"
+)
+
+type Format int
+
+const (
+	FormatText Format = iota
+	FormatJSON
+)
+
+func ParseFormat(value string) (Format, error) {
+	switch value {
+	case "", "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	default:
+		return FormatText, fmt.Errorf("unknown log format %q", value)
+	}
+}
+
+func ParseLevel(value string) (slog.Level, error) {
+	if value == "" {
+		return slog.LevelInfo, nil
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.ToUpper(value))); err != nil {
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q", value)
+	}
+
+	return level, nil
+}
+
+type Config struct {
+	Level      slog.Level
+	Format     Format
+	InstanceID string
+	// Records below Error are sampled by message: the first SampleInitial of
+	// each second are written, then one in every SampleThereafter. A
+	// SampleThereafter of 0 writes every record.
+	SampleInitial    int
+	SampleThereafter int
+}
+
+// Setup builds the logger described by config and makes it the default of
+// both slog and the log package.
+func Setup(w io.Writer, config Config) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: config.Level}
+
+	var handler slog.Handler
+	switch config.Format {
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		handler = slog.NewTextHandler(w, opts)
+	}
+
+	if config.SampleThereafter > 0 {
+		handler = newSamplingHandler(handler, config.SampleInitial, config.SampleThereafter)
+	}
+
+	logger := slog.New(handler).With(InstanceIDKey, config.InstanceID)
+	slog.SetDefault(logger)
+
+	return logger
+}
+
+type contextKey struct{}
+
+// FromContext returns the logger carried by ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// With returns a context whose logger adds args to every record.
+func With(ctx context.Context, args ...any) context.Context {
+	return NewContext(ctx, FromContext(ctx).With(args...))
+}
+
+// WithTrace adds the id of the trace in ctx, if any, so that the records can
+// be joined with the spans of the same payment.
+func WithTrace(ctx context.Context) context.Context {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return ctx
+	}
+
+	return With(ctx, TraceIDKey, spanContext.TraceID().String())
+}
+
+// Err is the attribute of an error.
+func Err(err error) slog.Attr {
+	return slog.Any(ErrorKey, err)
+}
@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const sampleTick = time.Second
+
+// samplingHandler caps how many records with the same level and message are
+// written per tick, so that hot paths cannot flood the output. Errors are
+// always written.
+type samplingHandler struct {
+	next    slog.Handler
+	sampler *sampler
+}
+
+type sampler struct {
+	initial    int
+	thereafter int
+
+	mu     sync.Mutex
+	tick   time.Time
+	counts map[sampleKey]int
+}
+
+type sampleKey struct {
+	level   slog.Level
+	message string
+}
+
+func newSamplingHandler(next slog.Handler, initial, thereafter int) *samplingHandler {
+	return &samplingHandler{
+		next: next,
+		sampler: &sampler{
+			initial:    initial,
+			thereafter: thereafter,
+			counts:     make(map[sampleKey]int),
+		},
+	}
+}
+
+func (h *samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level < slog.LevelError && !h.sampler.allow(record.Level, record.Message) {
+		return nil
+	}
+
+	return h.next.Handle(ctx, record)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{next: h.next.WithAttrs(attrs), sampler: h.sampler}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{next: h.next.WithGroup(name), sampler: h.sampler}
+}
+
+func (s *sampler) allow(level slog.Level, message string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.tick) >= sampleTick {
+		s.tick = now
+		clear(s.counts)
+	}
+
+	key := sampleKey{level: level, message: message}
+	s.counts[key]++
+	n := s.counts[key]
+
+	return n <= s.initial || (n-s.initial)%s.thereafter == 0
+}
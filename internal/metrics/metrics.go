@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const Namespace = "payments_proxy"
+
+// Buckets of the gateway call latency, matching the range processors answer
+// in, from a few milliseconds to the client timeout.
+var gatewayLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 1.5, 2, 3, 5, 10}
+
+var (
+	paymentRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "payment_requests_total",
+		Help:      "POST /payments requests by response code; 202 is an accepted payment.",
+	}, []string{"code"})
+
+	paymentRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "payment_request_duration_seconds",
+		Help:      "Latency of POST /payments by response code.",
+		Buckets:   []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1},
+	}, []string{"code"})
+
+	EnqueueFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "enqueue_failures_total",
+		Help:      "Accepted payments that could not be added to the stream.",
+	})
+
+	GatewayCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "gateway_calls_total",
+		Help:      "ProcessPayment calls by gateway and outcome: success or the error kind.",
+	}, []string{"gateway", "outcome"})
+
+	GatewayCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "gateway_call_duration_seconds",
+		Help:      "Latency of ProcessPayment calls by gateway.",
+		Buckets:   gatewayLatencyBuckets,
+	}, []string{"gateway"})
+
+	RoutingDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "routing_decisions_total",
+		Help:      "Gateways chosen for payments; none when no gateway was available.",
+	}, []string{"gateway"})
+
+	AutoClaimRecovered = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "autoclaim_recovered_total",
+		Help:      "Pending messages of other consumers reclaimed by this instance.",
+	})
+)
+
+// InstrumentPayments counts and times the requests to the payment ingestion
+// handler.
+func InstrumentPayments(next http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerDuration(paymentRequestDuration,
+		promhttp.InstrumentHandlerCounter(paymentRequests, next))
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
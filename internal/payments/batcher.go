@@ -0,0 +1,159 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vrtineu/payments-proxy/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrBatcherClosed = errors.New("enqueue batcher closed")
+
+type enqueueRequest struct {
+	payment  TracedPayment
+	deadline time.Time
+	result   chan error
+}
+
+// EnqueueBatcher groups concurrent enqueues into a single pipelined round trip
+// so that synchronous acknowledgement does not pay one XADD latency per request.
+type EnqueueBatcher struct {
+	queue    *PaymentsQueue
+	requests chan enqueueRequest
+	done     chan struct{}
+	maxBatch int
+	linger   time.Duration
+	timeout  time.Duration
+	flushes  sync.WaitGroup
+}
+
+func NewEnqueueBatcher(queue *PaymentsQueue, maxBatch int, linger time.Duration) *EnqueueBatcher {
+	return &EnqueueBatcher{
+		queue:    queue,
+		requests: make(chan enqueueRequest, maxBatch*4),
+		done:     make(chan struct{}),
+		maxBatch: maxBatch,
+		linger:   linger,
+		timeout:  5 * time.Second,
+	}
+}
+
+func (b *EnqueueBatcher) Enqueue(ctx context.Context, payment Payment) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "payments.enqueue",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(tracing.CorrelationIDKey.String(payment.CorrelationID)),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	req := enqueueRequest{
+		payment: TracedPayment{Payment: payment, Trace: tracing.Carrier(ctx)},
+		result:  make(chan error, 1),
+	}
+	req.deadline, _ = ctx.Deadline()
+
+	select {
+	case b.requests <- req:
+	case <-b.done:
+		return ErrBatcherClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Once submitted the request is always flushed, so its outcome is awaited
+	// regardless of the caller's context to avoid reporting a false failure.
+	// The flush is bounded by the caller's deadline instead.
+	select {
+	case err := <-req.result:
+		return err
+	case <-b.done:
+		select {
+		case err := <-req.result:
+			return err
+		default:
+			return ErrBatcherClosed
+		}
+	}
+}
+
+func (b *EnqueueBatcher) Start(ctx context.Context) {
+	defer close(b.done)
+
+	for {
+		var first enqueueRequest
+		select {
+		case <-ctx.Done():
+			b.drain()
+			return
+		case first = <-b.requests:
+		}
+
+		batch := make([]enqueueRequest, 0, b.maxBatch)
+		batch = append(batch, first)
+		linger := time.NewTimer(b.linger)
+
+	collect:
+		for len(batch) < b.maxBatch {
+			select {
+			case req := <-b.requests:
+				batch = append(batch, req)
+			case <-linger.C:
+				break collect
+			}
+		}
+		linger.Stop()
+
+		b.flushes.Add(1)
+		go func() {
+			defer b.flushes.Done()
+			b.flush(batch)
+		}()
+	}
+}
+
+// Done is closed once Start returned and every submitted request was flushed.
+func (b *EnqueueBatcher) Done() <-chan struct{} {
+	return b.done
+}
+
+func (b *EnqueueBatcher) drain() {
+	var batch []enqueueRequest
+	for {
+		select {
+		case req := <-b.requests:
+			batch = append(batch, req)
+		default:
+			if len(batch) > 0 {
+				b.flush(batch)
+			}
+			b.flushes.Wait()
+			return
+		}
+	}
+}
+
+// flush writes the batch within the earliest deadline of its requests, so
+// that no caller waits past its own.
+func (b *EnqueueBatcher) flush(batch []enqueueRequest) {
+	deadline := time.Now().Add(b.timeout)
+	for _, req := range batch {
+		if !req.deadline.IsZero() && req.deadline.Before(deadline) {
+			deadline = req.deadline
+		}
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	batchPayments := make([]TracedPayment, len(batch))
+	for i, req := range batch {
+		batchPayments[i] = req.payment
+	}
+
+	errs := b.queue.EnqueueBatch(ctx, batchPayments)
+	for i, req := range batch {
+		req.result <- errs[i]
+	}
+}
@@ -0,0 +1,45 @@
+package payments
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	ErrCodeValidationFailed   = "validation_failed"
+	ErrCodeMalformedJSON      = "malformed_json"
+	ErrCodeBodyTooLarge       = "body_too_large"
+	ErrCodeMethodNotAllowed   = "method_not_allowed"
+	ErrCodeIdempotency        = "idempotency_conflict"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeServiceUnavailable = "service_unavailable"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ErrorBody struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Details []FieldError `json:"details,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// WriteError answers with the error envelope shared by every endpoint.
+func WriteError(w http.ResponseWriter, status int, code, message string, details ...FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error: ErrorBody{
+			Code:    code,
+			Message: message,
+			Details: details,
+		},
+	})
+}
@@ -0,0 +1,96 @@
+package payments
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const feeRateScale = 1_000_000
+
+var ErrInvalidFeeRate = errors.New("invalid fee rate")
+
+// FeeRate is a fee expressed as a fraction of the amount, stored in millionths
+// so that 0.05 (5%) is 50000. Like Money it never goes through float64.
+type FeeRate int64
+
+func ParseFeeRate(value string) (FeeRate, error) {
+	if !isDecimalLiteral(value) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidFeeRate, value)
+	}
+
+	rat, ok := new(big.Rat).SetString(value)
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidFeeRate, value)
+	}
+
+	millionths, err := roundHalfEven(rat.Mul(rat, big.NewRat(feeRateScale, 1)))
+	if err != nil || millionths < 0 || millionths > feeRateScale {
+		return 0, fmt.Errorf("%w: %q must be between 0 and 1", ErrInvalidFeeRate, value)
+	}
+
+	return FeeRate(millionths), nil
+}
+
+func MustParseFeeRate(value string) FeeRate {
+	rate, err := ParseFeeRate(value)
+	if err != nil {
+		panic(err)
+	}
+
+	return rate
+}
+
+func (r FeeRate) String() string {
+	fraction := strings.TrimRight(fmt.Sprintf("%06d", int64(r)%feeRateScale), "0")
+	if fraction == "" {
+		return strconv.FormatInt(int64(r)/feeRateScale, 10)
+	}
+
+	return fmt.Sprintf("%d.%s", int64(r)/feeRateScale, fraction)
+}
+
+func (r FeeRate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalJSON accepts the rate either as a JSON number or as a string.
+func (r *FeeRate) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	value := string(data)
+	if strings.HasPrefix(value, `"`) {
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+	}
+
+	parsed, err := ParseFeeRate(value)
+	if err != nil {
+		return err
+	}
+
+	*r = parsed
+	return nil
+}
+
+// MarshalText and UnmarshalText let configuration formats other than JSON carry
+// the rate as a decimal string.
+func (r FeeRate) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *FeeRate) UnmarshalText(data []byte) error {
+	parsed, err := ParseFeeRate(string(data))
+	if err != nil {
+		return err
+	}
+
+	*r = parsed
+	return nil
+}
@@ -3,22 +3,63 @@ package payments
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
+
+	"github.com/vrtineu/payments-proxy/internal/logging"
+	"github.com/vrtineu/payments-proxy/internal/metrics"
+)
+
+type AckMode int
+
+const (
+	// AckAsync answers 202 before the payment is persisted in the stream.
+	AckAsync AckMode = iota
+	// AckDurable answers 202 only after the payment is persisted in the stream.
+	AckDurable
+)
+
+const (
+	durableEnqueueTimeout = 2 * time.Second
+	retryAfterSeconds     = "1"
 )
 
 type PaymentHandlers struct {
-	queue   *PaymentsQueue
-	storage *PaymentsStorage
+	queue       Enqueuer
+	storage     *PaymentsStorage
+	idempotency *IdempotencyStore
+	statuses    *PaymentStatusStore
+	gateways    []GatewayInfo
+	ackMode     AckMode
+	// Asynchronous enqueues still running after their request was answered.
+	// Once Wait sets closed, under mu, no new one is added to pending and
+	// late requests enqueue before answering instead.
+	pending sync.WaitGroup
+	mu      sync.Mutex
+	closed  bool
 }
 
-func NewPaymentHandlers(queue *PaymentsQueue, storage *PaymentsStorage) *PaymentHandlers {
+func NewPaymentHandlers(queue Enqueuer, storage *PaymentsStorage, idempotency *IdempotencyStore, statuses *PaymentStatusStore, gateways []GatewayInfo, ackMode AckMode) *PaymentHandlers {
 	return &PaymentHandlers{
-		queue:   queue,
-		storage: storage,
+		queue:       queue,
+		storage:     storage,
+		idempotency: idempotency,
+		statuses:    statuses,
+		gateways:    gateways,
+		ackMode:     ackMode,
+	}
+}
+
+func ParseAckMode(value string) (AckMode, error) {
+	switch value {
+	case "", "async":
+		return AckAsync, nil
+	case "durable":
+		return AckDurable, nil
+	default:
+		return AckAsync, fmt.Errorf("unknown ack mode %q", value)
 	}
 }
 
@@ -28,52 +69,208 @@ func (h *PaymentHandlers) CreatePaymentHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	var payment Payment
-	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	payment, reqErr := decodePayment(w, r)
+	if reqErr != nil {
+		reqErr.write(w)
 		return
 	}
 
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx := logging.With(logging.WithTrace(r.Context()), logging.CorrelationIDKey, payment.CorrelationID)
+	logger := logging.FromContext(ctx)
+
+	result, err := h.idempotency.Reserve(ctx, payment)
+	if err != nil {
+		logger.Error("reserving idempotency key", logging.Err(err))
+		writeServiceUnavailable(w)
+		return
+	}
+
+	switch result {
+	case IdempotencyConflict:
+		WriteError(w, http.StatusConflict, ErrCodeIdempotency, "Payment already received with a different amount", FieldError{
+			Field:   "amount",
+			Code:    "mismatch",
+			Message: "differs from the amount of the original request",
+		})
+		return
+	case IdempotencyReplay:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case IdempotencyPending:
+		// The original request is still enqueuing the payment and may yet
+		// fail, so the replay cannot be acknowledged.
+		writeServiceUnavailable(w)
+		return
+	}
+
+	if err := h.statuses.Update(ctx, payment.CorrelationID, StatusUpdate{
+		State:  StateReceived,
+		Amount: &payment.Amount,
+	}); err != nil {
+		logger.Error("recording received status", logging.Err(err))
+	}
+
+	if h.ackMode == AckDurable || !h.startAsync() {
+		ctx, cancel := context.WithTimeout(ctx, durableEnqueueTimeout)
 		defer cancel()
 
-		if err := h.queue.Enqueue(ctx, payment); err != nil {
-			log.Printf("Error enqueuing payment: %v\n", err)
+		if err := h.enqueue(ctx, payment); err != nil {
+			writeServiceUnavailable(w)
+			return
 		}
-	}()
+	} else {
+		go func() {
+			defer h.pending.Done()
+
+			// Detached from the request, which is answered before the enqueue
+			// ends, but still part of its trace.
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			defer cancel()
+
+			h.enqueue(ctx, payment)
+		}()
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 }
 
-type GatewaySummary struct {
-	TotalRequests int64   `json:"totalRequests"`
-	TotalAmount   float64 `json:"totalAmount"`
+// startAsync registers an asynchronous enqueue, unless Wait was called.
+func (h *PaymentHandlers) startAsync() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return false
+	}
+
+	h.pending.Add(1)
+	return true
 }
 
-type PaymentsSummaryResponse struct {
-	Default  GatewaySummary `json:"default"`
-	Fallback GatewaySummary `json:"fallback"`
+// Wait blocks until the asynchronous enqueues of answered requests finish or
+// ctx is done. Requests still being handled afterwards, when the server did
+// not shut down in time, enqueue synchronously.
+func (h *PaymentHandlers) Wait(ctx context.Context) error {
+	h.mu.Lock()
+	h.closed = true
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (h *PaymentHandlers) PaymentsSummaryHandler(w http.ResponseWriter, r *http.Request) {
+func (h *PaymentHandlers) enqueue(ctx context.Context, payment Payment) error {
+	logger := logging.FromContext(ctx)
+
+	err := h.queue.Enqueue(ctx, payment)
+	if err == nil {
+		// Like the release below, the confirmation must not be cut short by an
+		// enqueue that used up the context: an unconfirmed key expires and turns
+		// the client retry into a second payment.
+		confirmCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+		defer cancel()
+
+		if err := h.idempotency.Confirm(confirmCtx, payment); err != nil {
+			logger.Error("confirming idempotency key", logging.Err(err))
+		}
+		if err := h.statuses.Update(ctx, payment.CorrelationID, StatusUpdate{State: StateQueued}); err != nil {
+			logger.Error("recording queued status", logging.Err(err))
+		}
+		logger.Debug("payment enqueued")
+		return nil
+	}
+
+	logger.Error("enqueuing payment", logging.Err(err))
+	metrics.EnqueueFailures.Inc()
+
+	// The key is released with a fresh context because the enqueue context may
+	// already be expired, and a stale key would turn the client retry into a replay.
+	releaseCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if releaseErr := h.idempotency.Release(releaseCtx, payment.CorrelationID); releaseErr != nil {
+		logger.Error("releasing idempotency key", logging.Err(releaseErr))
+	}
+
+	if deleteErr := h.statuses.Delete(releaseCtx, payment.CorrelationID); deleteErr != nil {
+		logger.Error("deleting payment status", logging.Err(deleteErr))
+	}
+
+	return err
+}
+
+func (h *PaymentHandlers) PaymentStatusHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		handleMethodNotAllowed(w)
 		return
 	}
 
-	fromTime, _ := time.Parse(time.RFC3339, r.URL.Query().Get("from"))
-	toTime, _ := time.Parse(time.RFC3339, r.URL.Query().Get("to"))
-	fromScore := fromTime.UnixNano()
-	toScore := toTime.UnixNano()
+	correlationID := r.PathValue("correlationId")
+	if !isUUID(correlationID) {
+		WriteError(w, http.StatusBadRequest, ErrCodeValidationFailed, "Invalid path parameters", FieldError{
+			Field:   "correlationId",
+			Code:    "invalid_format",
+			Message: "must be a UUID",
+		})
+		return
+	}
 
-	defaultData, _ := h.storage.GetPaymentsByScoreRange(r.Context(), Default, float64(fromScore), float64(toScore))
-	fallbackData, _ := h.storage.GetPaymentsByScoreRange(r.Context(), Fallback, float64(fromScore), float64(toScore))
+	ctx := logging.With(logging.WithTrace(r.Context()), logging.CorrelationIDKey, correlationID)
+	status, err := h.statuses.Get(ctx, correlationID)
+	if err != nil {
+		logging.FromContext(ctx).Error("reading payment status", logging.Err(err))
+		writeServiceUnavailable(w)
+		return
+	}
 
-	response := PaymentsSummaryResponse{
-		Default:  h.calculateSummary(defaultData),
-		Fallback: h.calculateSummary(fallbackData),
+	if status == nil {
+		WriteError(w, http.StatusNotFound, ErrCodeNotFound, "Payment not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+// PaymentsSummaryResponse maps each configured gateway name to its summary.
+type PaymentsSummaryResponse map[GatewayType]GatewaySummary
+
+func (h *PaymentHandlers) PaymentsSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleMethodNotAllowed(w)
+		return
+	}
+
+	fromTime, fromErr := parseTimeParam(r, "from")
+	toTime, toErr := parseTimeParam(r, "to")
+	if details := collectFieldErrors(fromErr, toErr); len(details) > 0 {
+		WriteError(w, http.StatusBadRequest, ErrCodeValidationFailed, "Invalid query parameters", details...)
+		return
+	}
+
+	ctx := logging.WithTrace(r.Context())
+	response := make(PaymentsSummaryResponse, len(h.gateways))
+	for _, gateway := range h.gateways {
+		summary, err := h.storage.Summary(ctx, gateway, fromTime, toTime)
+		if err != nil {
+			logging.FromContext(ctx).Error("summarizing payments", logging.Err(err), logging.GatewayKey, gateway.Name)
+			writeServiceUnavailable(w)
+			return
+		}
+		response[gateway.Name] = summary
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -82,23 +279,41 @@ func (h *PaymentHandlers) PaymentsSummaryHandler(w http.ResponseWriter, r *http.
 }
 
 func handleMethodNotAllowed(w http.ResponseWriter) {
-	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	WriteError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
 }
 
-func (h *PaymentHandlers) calculateSummary(data []string) GatewaySummary {
-	var totalAmount float64
-	totalRequests := int64(len(data))
+func writeServiceUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", retryAfterSeconds)
+	WriteError(w, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "Service unavailable, retry later")
+}
+
+// parseTimeParam returns the zero time when the parameter is missing, which
+// leaves that end of the summary range open.
+func parseTimeParam(r *http.Request, name string) (time.Time, *FieldError) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
 
-	for _, entry := range data {
-		parts := strings.Split(entry, ":")
-		if len(parts) == 2 {
-			amount, _ := strconv.ParseFloat(parts[1], 64)
-			totalAmount += amount
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, &FieldError{
+			Field:   name,
+			Code:    "invalid_format",
+			Message: "must be an RFC 3339 timestamp",
 		}
 	}
 
-	return GatewaySummary{
-		TotalRequests: totalRequests,
-		TotalAmount:   totalAmount,
+	return t, nil
+}
+
+func collectFieldErrors(errs ...*FieldError) []FieldError {
+	var details []FieldError
+	for _, err := range errs {
+		if err != nil {
+			details = append(details, *err)
+		}
 	}
+
+	return details
 }
@@ -0,0 +1,94 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type IdempotencyResult int
+
+const (
+	IdempotencyNew IdempotencyResult = iota
+	IdempotencyReplay
+	IdempotencyConflict
+	// IdempotencyPending is a replay of a payment whose enqueue has not been
+	// confirmed yet; it may still fail and release the key.
+	IdempotencyPending
+)
+
+// A reservation stays pending until its enqueue is confirmed. It expires much
+// sooner than a confirmed one, so that an instance dying mid-enqueue does not
+// block the client's retries for the whole TTL.
+const idempotencyPendingTTL = 10 * time.Second
+
+// Reserves the correlationId when it is unseen, otherwise compares the stored
+// fingerprint with the incoming one. Runs atomically so two concurrent retries
+// cannot both be treated as new. Values are "<state>:<fingerprint>"; values
+// without a state predate it and are confirmed.
+var reserveIdempotencyKeyScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if not current then
+	redis.call('SET', KEYS[1], 'pending:' .. ARGV[1], 'PX', ARGV[2])
+	return 0
+end
+local state, fingerprint = string.match(current, '^(%a+):(.*)$')
+if not state then
+	state, fingerprint = 'enqueued', current
+end
+if fingerprint ~= ARGV[1] then
+	return 2
+end
+if state == 'pending' then
+	return 3
+end
+return 1
+`)
+
+type IdempotencyStore struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+func NewIdempotencyStore(rdb *redis.Client, ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		rdb: rdb,
+		ttl: ttl,
+	}
+}
+
+func (s *IdempotencyStore) Reserve(ctx context.Context, payment Payment) (IdempotencyResult, error) {
+	res, err := reserveIdempotencyKeyScript.Run(
+		ctx,
+		s.rdb,
+		[]string{idempotencyKey(payment.CorrelationID)},
+		idempotencyFingerprint(payment),
+		idempotencyPendingTTL.Milliseconds(),
+	).Int()
+	if err != nil {
+		return IdempotencyNew, err
+	}
+
+	return IdempotencyResult(res), nil
+}
+
+// Confirm marks the reservation of an enqueued payment, so that replays are
+// acknowledged for the whole TTL. The key is written even when the pending
+// reservation already expired, since the payment is enqueued either way.
+func (s *IdempotencyStore) Confirm(ctx context.Context, payment Payment) error {
+	return s.rdb.Set(ctx, idempotencyKey(payment.CorrelationID), "enqueued:"+idempotencyFingerprint(payment), s.ttl).Err()
+}
+
+func (s *IdempotencyStore) Release(ctx context.Context, correlationID string) error {
+	return s.rdb.Del(ctx, idempotencyKey(correlationID)).Err()
+}
+
+func idempotencyKey(correlationID string) string {
+	return fmt.Sprintf("idempotency:%s", correlationID)
+}
+
+func idempotencyFingerprint(payment Payment) string {
+	return payment.Amount.String()
+}
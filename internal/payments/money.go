@@ -0,0 +1,192 @@
+package payments
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+const (
+	centsPerUnit = 100
+	// Bounds the exponent accepted in scientific notation so a tiny input such as
+	// "1e999999999" cannot force a huge big.Int allocation.
+	maxMoneyExponent = 32
+)
+
+var (
+	ErrInvalidMoney   = errors.New("invalid monetary amount")
+	ErrMoneyOverflow  = errors.New("monetary amount out of range")
+	ErrMoneyPrecision = errors.New("monetary amount has more than two decimal places")
+)
+
+// Money is an exact monetary amount expressed in cents.
+//
+// Values are parsed from their decimal representation without going through
+// float64, and inputs that are not a whole number of cents are rejected.
+// Derived values such as fees are rounded to the nearest cent, with ties
+// rounded to the even cent (banker's rounding).
+type Money int64
+
+func ParseMoney(value string) (Money, error) {
+	if !isDecimalLiteral(value) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidMoney, value)
+	}
+
+	rat, ok := new(big.Rat).SetString(value)
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidMoney, value)
+	}
+
+	rat.Mul(rat, big.NewRat(centsPerUnit, 1))
+	if !rat.IsInt() {
+		return 0, fmt.Errorf("%w: %q", ErrMoneyPrecision, value)
+	}
+
+	cents, err := roundHalfEven(rat)
+	return Money(cents), err
+}
+
+func MoneyFromCents(cents int64) Money {
+	return Money(cents)
+}
+
+func (m Money) Cents() int64 {
+	return int64(m)
+}
+
+func (m Money) String() string {
+	cents := int64(m)
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+	}
+
+	abs := uint64(cents)
+	if cents < 0 {
+		abs = uint64(-cents)
+	}
+
+	return fmt.Sprintf("%s%d.%02d", sign, abs/centsPerUnit, abs%centsPerUnit)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	if len(data) == 0 || data[0] == '"' || !json.Valid(data) {
+		return fmt.Errorf("%w: %s is not a JSON number", ErrInvalidMoney, data)
+	}
+
+	parsed, err := ParseMoney(string(data))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidMoney, err)
+	}
+
+	*m = parsed
+	return nil
+}
+
+func (m Money) Add(other Money) (Money, error) {
+	if (other > 0 && m > math.MaxInt64-other) || (other < 0 && m < math.MinInt64-other) {
+		return 0, ErrMoneyOverflow
+	}
+
+	return m + other, nil
+}
+
+// ApplyRate returns the share of m given by rate, rounded to the cent with the
+// same half-to-even rule used when parsing.
+func (m Money) ApplyRate(rate FeeRate) Money {
+	share := new(big.Rat).SetFrac(
+		new(big.Int).Mul(big.NewInt(int64(m)), big.NewInt(int64(rate))),
+		big.NewInt(feeRateScale),
+	)
+
+	// A rate is at most 1, so the share always fits in the amount's range.
+	cents, _ := roundHalfEven(share)
+	return Money(cents)
+}
+
+func roundHalfEven(value *big.Rat) (int64, error) {
+	quo, rem := new(big.Int).QuoRem(value.Num(), value.Denom(), new(big.Int))
+
+	// Round half to even: compare twice the remainder with the denominator.
+	twiceRem := new(big.Int).Abs(rem)
+	twiceRem.Lsh(twiceRem, 1)
+	switch twiceRem.Cmp(value.Denom()) {
+	case 1:
+		quo.Add(quo, big.NewInt(int64(rem.Sign())))
+	case 0:
+		if quo.Bit(0) == 1 {
+			quo.Add(quo, big.NewInt(int64(rem.Sign())))
+		}
+	}
+
+	if !quo.IsInt64() {
+		return 0, ErrMoneyOverflow
+	}
+
+	return quo.Int64(), nil
+}
+
+// isDecimalLiteral accepts the JSON number grammar with a bounded exponent,
+// rejecting the fractions and hexadecimal forms big.Rat would otherwise allow.
+func isDecimalLiteral(value string) bool {
+	i := 0
+	if i < len(value) && (value[i] == '-' || value[i] == '+') {
+		i++
+	}
+
+	digits := 0
+	for i < len(value) && isDigit(value[i]) {
+		i++
+		digits++
+	}
+
+	if i < len(value) && value[i] == '.' {
+		i++
+		for i < len(value) && isDigit(value[i]) {
+			i++
+			digits++
+		}
+	}
+
+	if digits == 0 {
+		return false
+	}
+
+	if i < len(value) && (value[i] == 'e' || value[i] == 'E') {
+		i++
+		if i < len(value) && (value[i] == '-' || value[i] == '+') {
+			i++
+		}
+
+		exponent := 0
+		expDigits := 0
+		for i < len(value) && isDigit(value[i]) {
+			exponent = exponent*10 + int(value[i]-'0')
+			if exponent > maxMoneyExponent {
+				return false
+			}
+			i++
+			expDigits++
+		}
+
+		if expDigits == 0 {
+			return false
+		}
+	}
+
+	return i == len(value)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,162 @@
+package payments
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Money
+		err   error
+	}{
+		{value: "19.90", want: 1990},
+		{value: "19.9", want: 1990},
+		{value: "10", want: 1000},
+		{value: "10.000", want: 1000},
+		{value: "0.01", want: 1},
+		{value: "-1.50", want: -150},
+		{value: "1e2", want: 10000},
+		{value: "1.5E1", want: 1500},
+		{value: "1e-2", want: 1},
+		{value: "92233720368547758.07", want: 9223372036854775807},
+		{value: "10.005", err: ErrMoneyPrecision},
+		{value: "0.004", err: ErrMoneyPrecision},
+		{value: "1e-3", err: ErrMoneyPrecision},
+		{value: "92233720368547758.08", err: ErrMoneyOverflow},
+		{value: "", err: ErrInvalidMoney},
+		{value: "abc", err: ErrInvalidMoney},
+		{value: "1/2", err: ErrInvalidMoney},
+		{value: "0x10", err: ErrInvalidMoney},
+		{value: "1e999999999", err: ErrInvalidMoney},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseMoney(tt.value)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("ParseMoney(%q) error = %v, want %v", tt.value, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMoney(%q) unexpected error: %v", tt.value, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseMoney(%q) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		data string
+		want Money
+		err  error
+	}{
+		{data: "19.90", want: 1990},
+		{data: "null", want: 0},
+		{data: "10.005", err: ErrMoneyPrecision},
+		{data: `"19.90"`, err: ErrInvalidMoney},
+		{data: "19.90.1", err: ErrInvalidMoney},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.data, func(t *testing.T) {
+			var got Money
+			err := got.UnmarshalJSON([]byte(tt.data))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("UnmarshalJSON(%s) error = %v, want %v", tt.data, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UnmarshalJSON(%s) unexpected error: %v", tt.data, err)
+			}
+			if got != tt.want {
+				t.Errorf("UnmarshalJSON(%s) = %d, want %d", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{money: 0, want: "0.00"},
+		{money: 1, want: "0.01"},
+		{money: 1990, want: "19.90"},
+		{money: -150, want: "-1.50"},
+		{money: -9223372036854775808, want: "-92233720368547758.08"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.money.String(); got != tt.want {
+			t.Errorf("Money(%d).String() = %q, want %q", int64(tt.money), got, tt.want)
+		}
+	}
+}
+
+func TestRoundHalfEven(t *testing.T) {
+	tests := []struct {
+		num, denom int64
+		want       int64
+	}{
+		{num: 5, denom: 2, want: 2},
+		{num: 7, denom: 2, want: 4},
+		{num: -5, denom: 2, want: -2},
+		{num: -7, denom: 2, want: -4},
+		{num: 1, denom: 2, want: 0},
+		{num: 3, denom: 2, want: 2},
+		{num: 251, denom: 100, want: 3},
+		{num: 249, denom: 100, want: 2},
+		{num: -251, denom: 100, want: -3},
+		{num: 4, denom: 1, want: 4},
+	}
+
+	for _, tt := range tests {
+		got, err := roundHalfEven(big.NewRat(tt.num, tt.denom))
+		if err != nil {
+			t.Fatalf("roundHalfEven(%d/%d) unexpected error: %v", tt.num, tt.denom, err)
+		}
+		if got != tt.want {
+			t.Errorf("roundHalfEven(%d/%d) = %d, want %d", tt.num, tt.denom, got, tt.want)
+		}
+	}
+
+	tooBig := new(big.Rat).SetInt(new(big.Int).Lsh(big.NewInt(1), 63))
+	if _, err := roundHalfEven(tooBig); !errors.Is(err, ErrMoneyOverflow) {
+		t.Errorf("roundHalfEven(2^63) error = %v, want %v", err, ErrMoneyOverflow)
+	}
+}
+
+func TestApplyRate(t *testing.T) {
+	tests := []struct {
+		money Money
+		rate  string
+		want  Money
+	}{
+		{money: 1990, rate: "0.05", want: 100},
+		{money: 1990, rate: "0.15", want: 298},
+		{money: 10, rate: "0.05", want: 0},
+		{money: 30, rate: "0.05", want: 2},
+		{money: 50, rate: "0.05", want: 2},
+		{money: 70, rate: "0.05", want: 4},
+		{money: 1000, rate: "0", want: 0},
+		{money: 1000, rate: "1", want: 1000},
+	}
+
+	for _, tt := range tests {
+		got := tt.money.ApplyRate(MustParseFeeRate(tt.rate))
+		if got != tt.want {
+			t.Errorf("Money(%d).ApplyRate(%s) = %d, want %d", int64(tt.money), tt.rate, got, tt.want)
+		}
+	}
+}
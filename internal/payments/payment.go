@@ -4,36 +4,40 @@ import (
 	"time"
 )
 
-type GatewayType int
+// GatewayType is the configured name of a payment processor. Default and
+// Fallback are the names used when no gateway registry is configured.
+type GatewayType string
 
 const (
-	Default GatewayType = iota
-	Fallback
+	Default  GatewayType = "default"
+	Fallback GatewayType = "fallback"
 )
 
 type Payment struct {
 	CorrelationID string      `json:"correlationId"`
-	Amount        float64     `json:"amount"`
+	Amount        Money       `json:"amount"`
 	RequestedAt   string      `json:"requestedAt"`
 	Gateway       GatewayType `json:"-"`
+	FeeRate       FeeRate     `json:"-"`
 }
 
-func NewPayment(correlationID string, amount float64, gateway GatewayType) *Payment {
+// GatewayInfo describes a configured gateway to code outside the processor
+// package, such as the summary handler.
+type GatewayInfo struct {
+	Name GatewayType
+	Fee  FeeRate
+}
+
+func NewPayment(correlationID string, amount Money, gateway GatewayType, feeRate FeeRate) *Payment {
 	return &Payment{
 		CorrelationID: correlationID,
 		Amount:        amount,
 		RequestedAt:   time.Now().UTC().Format(time.RFC3339),
 		Gateway:       gateway,
+		FeeRate:       feeRate,
 	}
 }
 
 func (g GatewayType) String() string {
-	switch g {
-	case Default:
-		return "default"
-	case Fallback:
-		return "fallback"
-	default:
-		return "unknown"
-	}
+	return string(g)
 }
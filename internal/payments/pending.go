@@ -0,0 +1,120 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// PendingAttempt is the gateway a payment was sent to, recorded before the
+// call is made. While it exists the payment must not be sent to any other
+// gateway before this one confirms it does not know the correlationId. It is
+// removed when the payment is completed or when the call certainly did not
+// charge it.
+//
+// StartedAt is when the latest call began; until it is old enough to have
+// ended, the call may still reach the gateway. Charged is set when the gateway
+// accepted the payment but recording it failed; the next delivery then only
+// records it.
+type PendingAttempt struct {
+	Gateway     GatewayType
+	RequestedAt string
+	FeeRate     FeeRate
+	StartedAt   time.Time
+	Charged     bool
+}
+
+// Payment rebuilds the payment as it was sent to the gateway.
+func (p *PendingAttempt) Payment(correlationID string, amount Money) *Payment {
+	return &Payment{
+		CorrelationID: correlationID,
+		Amount:        amount,
+		RequestedAt:   p.RequestedAt,
+		Gateway:       p.Gateway,
+		FeeRate:       p.FeeRate,
+	}
+}
+
+type PendingAttemptStore struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+func NewPendingAttemptStore(rdb *redis.Client, ttl time.Duration) *PendingAttemptStore {
+	return &PendingAttemptStore{
+		rdb: rdb,
+		ttl: ttl,
+	}
+}
+
+// Begin records that payment is about to be sent to its gateway. It must
+// succeed before the call is made.
+func (s *PendingAttemptStore) Begin(ctx context.Context, payment *Payment) error {
+	return s.save(ctx, payment, false)
+}
+
+// MarkCharged records that the gateway accepted payment, so that it is not
+// sent again.
+func (s *PendingAttemptStore) MarkCharged(ctx context.Context, payment *Payment) error {
+	return s.save(ctx, payment, true)
+}
+
+func (s *PendingAttemptStore) save(ctx context.Context, payment *Payment, charged bool) error {
+	key := pendingAttemptKey(payment.CorrelationID)
+
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"gateway", payment.Gateway.String(),
+			"requestedAt", payment.RequestedAt,
+			"feeRate", payment.FeeRate.String(),
+			"startedAt", time.Now().UnixMilli(),
+			"charged", strconv.FormatBool(charged),
+		)
+		pipe.PExpire(ctx, key, s.ttl)
+		return nil
+	})
+
+	return err
+}
+
+// Get returns the pending attempt of the payment, or nil when there is none.
+func (s *PendingAttemptStore) Get(ctx context.Context, correlationID string) (*PendingAttempt, error) {
+	values, err := s.rdb.HGetAll(ctx, pendingAttemptKey(correlationID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	feeRate, err := ParseFeeRate(values["feeRate"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid pending attempt fee rate: %w", err)
+	}
+
+	// Attempts recorded without a start are treated as long over.
+	var startedAt time.Time
+	if millis, err := strconv.ParseInt(values["startedAt"], 10, 64); err == nil {
+		startedAt = time.UnixMilli(millis)
+	}
+
+	return &PendingAttempt{
+		Gateway:     GatewayType(values["gateway"]),
+		RequestedAt: values["requestedAt"],
+		FeeRate:     feeRate,
+		StartedAt:   startedAt,
+		Charged:     values["charged"] == "true",
+	}, nil
+}
+
+func (s *PendingAttemptStore) Clear(ctx context.Context, correlationID string) error {
+	return s.rdb.Del(ctx, pendingAttemptKey(correlationID)).Err()
+}
+
+func pendingAttemptKey(correlationID string) string {
+	return fmt.Sprintf("payment:pending:%s", correlationID)
+}
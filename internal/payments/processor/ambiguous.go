@@ -0,0 +1,62 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vrtineu/payments-proxy/internal/logging"
+	"github.com/vrtineu/payments-proxy/internal/payments"
+)
+
+type ambiguousResolution int
+
+const (
+	// The pending gateway has no record of the payment and the attempt is over;
+	// routing may proceed.
+	resolutionNotFound ambiguousResolution = iota
+	// The pending gateway has no record of the payment yet, but the attempt may
+	// still reach it; the payment must be sent to that gateway again.
+	resolutionResend
+	// The pending gateway processed the payment and it has been recorded.
+	resolutionProcessed
+	// The outcome is still unknown and the message was handled as a failure.
+	resolutionUnresolved
+)
+
+// resolveAmbiguousAttempt asks the gateway that received a previous attempt
+// with no known outcome whether it processed the payment, recording it as it
+// was sent to that gateway when it did. While the gateway cannot answer, or the attempt
+// may still be in flight, the payment is not routed anywhere else.
+func (pw *PaymentWorker) resolveAmbiguousAttempt(ctx context.Context, msg redis.XMessage, correlationID string, amount payments.Money, pending *payments.PendingAttempt, attempts messageAttempts) ambiguousResolution {
+	gatewayName := pending.Gateway.String()
+
+	gateway := pw.registry.Get(gatewayName)
+	if gateway == nil {
+		logging.FromContext(ctx).Warn("unknown pending gateway, ignoring it", "pendingGateway", gatewayName)
+		return resolutionNotFound
+	}
+
+	err := gateway.LookupPayment(ctx, correlationID)
+	if errors.Is(err, ErrPaymentNotFound) {
+		// A call ends within the limit wait plus the client timeout; before
+		// that it may still arrive after the lookup.
+		if time.Since(pending.StartedAt) > pw.maxLimitWait+gateway.client.Timeout {
+			return resolutionNotFound
+		}
+		return resolutionResend
+	}
+
+	if err != nil {
+		pw.handleMessageFailure(ctx, msg, correlationID, gatewayName, fmt.Errorf("unresolved ambiguous outcome: %w", err), attempts)
+		return resolutionUnresolved
+	}
+
+	if !pw.completePayment(ctx, msg, pending.Payment(correlationID, amount), "ambiguous outcome confirmed by processor") {
+		return resolutionUnresolved
+	}
+
+	return resolutionProcessed
+}
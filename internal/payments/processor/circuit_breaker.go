@@ -0,0 +1,301 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vrtineu/payments-proxy/internal/logging"
+)
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	default:
+		return "unknown"
+	}
+}
+
+type CircuitBreakerConfig struct {
+	// Window is how long outcomes are accumulated before the counters reset.
+	Window      time.Duration
+	MinRequests int64
+	// ErrorRate and SlowCallRate are fractions of the calls in the window that
+	// open the circuit once MinRequests calls were observed.
+	ErrorRate      float64
+	SlowCall       time.Duration
+	SlowCallRate   float64
+	OpenDuration   time.Duration
+	HalfOpenTrials int64
+}
+
+// CircuitBreaker tracks the outcome of real payment calls to one gateway. It
+// opens when too many calls fail or are slow, rejects calls while open, and
+// after OpenDuration lets HalfOpenTrials calls through to decide whether to
+// close again.
+type CircuitBreaker struct {
+	config CircuitBreakerConfig
+
+	mu             sync.Mutex
+	state          CircuitState
+	openUntil      time.Time
+	windowStart    time.Time
+	requests       int64
+	failures       int64
+	slowCalls      int64
+	trialsStarted  int64
+	trialSuccesses int64
+}
+
+func NewCircuitBreaker(config CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		config:      config,
+		windowStart: time.Now(),
+	}
+}
+
+// State reports the current state without reserving a trial call.
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.advance(time.Now())
+	return cb.state
+}
+
+// CanAttempt reports whether Allow would currently let a call through.
+func (cb *CircuitBreaker) CanAttempt() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.advance(time.Now())
+	switch cb.state {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		return cb.trialsStarted < cb.config.HalfOpenTrials
+	default:
+		return true
+	}
+}
+
+// Allow reserves a call. Every allowed call must be followed by Record.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.advance(time.Now())
+	switch cb.state {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		if cb.trialsStarted >= cb.config.HalfOpenTrials {
+			return false
+		}
+		cb.trialsStarted++
+		return true
+	default:
+		return true
+	}
+}
+
+// Cancel releases a call reserved by Allow that was never made.
+func (cb *CircuitBreaker) Cancel() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitHalfOpen && cb.trialsStarted > 0 {
+		cb.trialsStarted--
+	}
+}
+
+func (cb *CircuitBreaker) Record(latency time.Duration, failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	cb.advance(now)
+
+	slow := cb.config.SlowCall > 0 && latency >= cb.config.SlowCall
+
+	switch cb.state {
+	case CircuitHalfOpen:
+		if failed || slow {
+			cb.open(now)
+			return
+		}
+
+		cb.trialSuccesses++
+		if cb.trialSuccesses >= cb.config.HalfOpenTrials {
+			cb.close(now)
+		}
+	case CircuitClosed:
+		cb.requests++
+		if failed {
+			cb.failures++
+		}
+		if slow {
+			cb.slowCalls++
+		}
+
+		if cb.requests < cb.config.MinRequests {
+			return
+		}
+
+		errorRate := float64(cb.failures) / float64(cb.requests)
+		slowRate := float64(cb.slowCalls) / float64(cb.requests)
+		if errorRate >= cb.config.ErrorRate || (cb.config.SlowCall > 0 && slowRate >= cb.config.SlowCallRate) {
+			cb.open(now)
+		}
+	}
+}
+
+// OpenUntil returns the end of the current open period, or the zero time when
+// the circuit is not open.
+func (cb *CircuitBreaker) OpenUntil() time.Time {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state != CircuitOpen {
+		return time.Time{}
+	}
+	return cb.openUntil
+}
+
+// ForceOpen opens the circuit until the given time, used when another instance
+// opened it first.
+func (cb *CircuitBreaker) ForceOpen(until time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if until.After(time.Now()) && until.After(cb.openUntil) {
+		cb.state = CircuitOpen
+		cb.openUntil = until
+		cb.trialsStarted = 0
+		cb.trialSuccesses = 0
+	}
+}
+
+func (cb *CircuitBreaker) advance(now time.Time) {
+	if cb.state == CircuitOpen && !now.Before(cb.openUntil) {
+		cb.state = CircuitHalfOpen
+		cb.trialsStarted = 0
+		cb.trialSuccesses = 0
+	}
+
+	if cb.state == CircuitClosed && now.Sub(cb.windowStart) >= cb.config.Window {
+		cb.resetWindow(now)
+	}
+}
+
+func (cb *CircuitBreaker) open(now time.Time) {
+	cb.state = CircuitOpen
+	cb.openUntil = now.Add(cb.config.OpenDuration)
+	cb.trialsStarted = 0
+	cb.trialSuccesses = 0
+}
+
+func (cb *CircuitBreaker) close(now time.Time) {
+	cb.state = CircuitClosed
+	cb.resetWindow(now)
+}
+
+func (cb *CircuitBreaker) resetWindow(now time.Time) {
+	cb.windowStart = now
+	cb.requests = 0
+	cb.failures = 0
+	cb.slowCalls = 0
+}
+
+// CircuitSync shares open circuits between instances through Redis: a circuit
+// opened locally is published with its deadline, and circuits opened elsewhere
+// are opened locally until the same deadline.
+type CircuitSync struct {
+	rdb       *redis.Client
+	registry  *GatewayRegistry
+	published map[string]time.Time
+}
+
+func NewCircuitSync(rdb *redis.Client, registry *GatewayRegistry) *CircuitSync {
+	return &CircuitSync{
+		rdb:       rdb,
+		registry:  registry,
+		published: make(map[string]time.Time),
+	}
+}
+
+func (cs *CircuitSync) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := cs.sync(ctx); err != nil {
+				slog.Error("syncing circuit breakers", logging.Err(err))
+			}
+		}
+	}
+}
+
+func (cs *CircuitSync) sync(ctx context.Context) error {
+	gateways := cs.registry.All()
+	cmds := make([]*redis.StringCmd, len(gateways))
+
+	_, err := cs.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, gateway := range gateways {
+			key := circuitKey(gateway.Name())
+
+			until := gateway.breaker.OpenUntil()
+			if ttl := time.Until(until); ttl > time.Millisecond && until.After(cs.published[gateway.Name()]) {
+				pipe.Set(ctx, key, until.UnixMilli(), ttl)
+				cs.published[gateway.Name()] = until
+			}
+
+			cmds[i] = pipe.Get(ctx, key)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	for i, gateway := range gateways {
+		untilMs, err := strconv.ParseInt(cmds[i].Val(), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		until := time.UnixMilli(untilMs)
+		gateway.breaker.ForceOpen(until)
+		if until.After(cs.published[gateway.Name()]) {
+			cs.published[gateway.Name()] = until
+		}
+	}
+
+	return nil
+}
+
+func circuitKey(gateway string) string {
+	return fmt.Sprintf("circuit:%s:open_until", gateway)
+}
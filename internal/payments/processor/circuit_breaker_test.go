@@ -0,0 +1,149 @@
+package processor
+
+import (
+	"testing"
+	"time"
+)
+
+const testOpenDuration = 20 * time.Millisecond
+
+func newTestCircuitBreaker() *CircuitBreaker {
+	return NewCircuitBreaker(CircuitBreakerConfig{
+		Window:         time.Minute,
+		MinRequests:    4,
+		ErrorRate:      0.5,
+		SlowCall:       time.Second,
+		SlowCallRate:   0.75,
+		OpenDuration:   testOpenDuration,
+		HalfOpenTrials: 2,
+	})
+}
+
+type callOutcome struct {
+	latency time.Duration
+	failed  bool
+}
+
+var (
+	okCall     = callOutcome{latency: 10 * time.Millisecond}
+	failedCall = callOutcome{latency: 10 * time.Millisecond, failed: true}
+	slowCall   = callOutcome{latency: 2 * time.Second}
+)
+
+func record(cb *CircuitBreaker, calls ...callOutcome) {
+	for _, call := range calls {
+		cb.Allow()
+		cb.Record(call.latency, call.failed)
+	}
+}
+
+// openTestCircuit opens the circuit and waits until it turns half-open.
+func openTestCircuit(t *testing.T, cb *CircuitBreaker) {
+	t.Helper()
+
+	record(cb, failedCall, failedCall, failedCall, failedCall)
+	if state := cb.State(); state != CircuitOpen {
+		t.Fatalf("state after failures = %v, want open", state)
+	}
+
+	time.Sleep(testOpenDuration + 5*time.Millisecond)
+	if state := cb.State(); state != CircuitHalfOpen {
+		t.Fatalf("state after the open duration = %v, want half_open", state)
+	}
+}
+
+func TestCircuitBreakerClosedTransitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		calls []callOutcome
+		want  CircuitState
+	}{
+		{name: "no calls", want: CircuitClosed},
+		{name: "failures below min requests", calls: []callOutcome{failedCall, failedCall, failedCall}, want: CircuitClosed},
+		{name: "error rate reached", calls: []callOutcome{okCall, okCall, failedCall, failedCall}, want: CircuitOpen},
+		{name: "error rate below threshold", calls: []callOutcome{okCall, okCall, okCall, failedCall}, want: CircuitClosed},
+		{name: "slow call rate reached", calls: []callOutcome{okCall, slowCall, slowCall, slowCall}, want: CircuitOpen},
+		{name: "slow call rate below threshold", calls: []callOutcome{okCall, okCall, slowCall, slowCall}, want: CircuitClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := newTestCircuitBreaker()
+			record(cb, tt.calls...)
+
+			if state := cb.State(); state != tt.want {
+				t.Errorf("state = %v, want %v", state, tt.want)
+			}
+			if allowed := cb.Allow(); allowed != (tt.want == CircuitClosed) {
+				t.Errorf("Allow() = %v in state %v", allowed, tt.want)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerHalfOpenTrials(t *testing.T) {
+	tests := []struct {
+		name   string
+		trials []callOutcome
+		want   CircuitState
+	}{
+		{name: "all trials succeed", trials: []callOutcome{okCall, okCall}, want: CircuitClosed},
+		{name: "first trial fails", trials: []callOutcome{failedCall}, want: CircuitOpen},
+		{name: "second trial fails", trials: []callOutcome{okCall, failedCall}, want: CircuitOpen},
+		{name: "trial is slow", trials: []callOutcome{slowCall}, want: CircuitOpen},
+		{name: "trials still running", trials: []callOutcome{okCall}, want: CircuitHalfOpen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := newTestCircuitBreaker()
+			openTestCircuit(t, cb)
+
+			record(cb, tt.trials...)
+			if state := cb.State(); state != tt.want {
+				t.Errorf("state = %v, want %v", state, tt.want)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerHalfOpenReservations(t *testing.T) {
+	cb := newTestCircuitBreaker()
+	openTestCircuit(t, cb)
+
+	if !cb.Allow() || !cb.Allow() {
+		t.Fatal("Allow() rejected one of the half-open trials")
+	}
+	if cb.Allow() || cb.CanAttempt() {
+		t.Fatal("Allow() admitted more calls than HalfOpenTrials")
+	}
+
+	// A reserved trial that is never made goes back to the pool.
+	cb.Cancel()
+	if !cb.CanAttempt() || !cb.Allow() {
+		t.Fatal("a cancelled trial was not released")
+	}
+}
+
+func TestCircuitBreakerForceOpen(t *testing.T) {
+	cb := newTestCircuitBreaker()
+
+	cb.ForceOpen(time.Now().Add(-time.Second))
+	if state := cb.State(); state != CircuitClosed {
+		t.Fatalf("state after forcing open in the past = %v, want closed", state)
+	}
+
+	until := time.Now().Add(time.Minute)
+	cb.ForceOpen(until)
+	if state := cb.State(); state != CircuitOpen {
+		t.Fatalf("state after forcing open = %v, want open", state)
+	}
+	if got := cb.OpenUntil(); !got.Equal(until) {
+		t.Errorf("OpenUntil() = %v, want %v", got, until)
+	}
+
+	cb.ForceOpen(until.Add(-time.Second))
+	if got := cb.OpenUntil(); !got.Equal(until) {
+		t.Errorf("OpenUntil() after an earlier deadline = %v, want %v", got, until)
+	}
+}
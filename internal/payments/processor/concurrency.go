@@ -0,0 +1,131 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Smoothing of the latency baseline; low so that a burst of slow calls stands
+// out against it instead of quickly becoming the new normal.
+const concurrencyBaselineSmoothing = 0.05
+
+type ConcurrencyConfig struct {
+	Initial int
+	Min     int
+	Max     int
+	// Tolerance is how many times the baseline latency a call may take before
+	// latency counts as rising.
+	Tolerance float64
+	// Backoff is the largest fraction of the limit kept after a failure or a
+	// latency rise.
+	Backoff float64
+}
+
+// ConcurrencyLimiter bounds the calls in flight to one gateway. The limit grows
+// additively while calls succeed close to the baseline latency and shrinks
+// multiplicatively, in proportion to the latency gradient, when latency rises
+// or calls fail.
+type ConcurrencyLimiter struct {
+	config ConcurrencyConfig
+
+	mu           sync.Mutex
+	limit        float64
+	inFlight     int
+	baseline     time.Duration
+	lastDecrease time.Time
+	released     chan struct{}
+}
+
+func NewConcurrencyLimiter(config ConcurrencyConfig) *ConcurrencyLimiter {
+	config.Min = max(config.Min, 1)
+	config.Max = max(config.Max, config.Min)
+
+	return &ConcurrencyLimiter{
+		config:   config,
+		limit:    float64(min(max(config.Initial, config.Min), config.Max)),
+		released: make(chan struct{}),
+	}
+}
+
+// Acquire waits for a free slot. Every successful Acquire must be followed by
+// Release.
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context) error {
+	for {
+		cl.mu.Lock()
+		if cl.inFlight < int(cl.limit) {
+			cl.inFlight++
+			cl.mu.Unlock()
+			return nil
+		}
+		released := cl.released
+		cl.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+func (cl *ConcurrencyLimiter) Release(latency time.Duration, failed bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	now := time.Now()
+	saturated := cl.inFlight >= int(cl.limit)
+	cl.inFlight--
+	close(cl.released)
+	cl.released = make(chan struct{})
+
+	if failed {
+		cl.decrease(now, latency, cl.config.Backoff)
+		return
+	}
+
+	if cl.baseline == 0 {
+		cl.baseline = latency
+		return
+	}
+
+	gradient := cl.config.Tolerance * float64(cl.baseline) / float64(max(latency, time.Microsecond))
+	cl.baseline += time.Duration(concurrencyBaselineSmoothing * float64(latency-cl.baseline))
+
+	if gradient < 1 {
+		cl.decrease(now, latency, max(gradient, cl.config.Backoff))
+		return
+	}
+
+	// Growing an idle limit would only allow a burst later on.
+	if saturated {
+		cl.limit = min(cl.limit+1/cl.limit, float64(cl.config.Max))
+	}
+}
+
+// Limit is the current number of calls allowed in flight.
+func (cl *ConcurrencyLimiter) Limit() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	return int(cl.limit)
+}
+
+func (cl *ConcurrencyLimiter) InFlight() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	return cl.inFlight
+}
+
+// decrease shrinks the limit at most once per batch of calls: calls that
+// started before the previous decrease were made under the old limit and say
+// nothing about the new one.
+func (cl *ConcurrencyLimiter) decrease(now time.Time, latency time.Duration, factor float64) {
+	if now.Add(-latency).Before(cl.lastDecrease) {
+		return
+	}
+
+	cl.limit = max(cl.limit*factor, float64(cl.config.Min))
+	cl.lastDecrease = now
+}
@@ -0,0 +1,93 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterAcquire(t *testing.T) {
+	cl := NewConcurrencyLimiter(ConcurrencyConfig{Initial: 2, Min: 1, Max: 4, Tolerance: 1.5, Backoff: 0.5})
+
+	for range 2 {
+		if err := cl.Acquire(context.Background()); err != nil {
+			t.Fatalf("Acquire() below the limit: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := cl.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Acquire() at the limit = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- cl.Acquire(context.Background()) }()
+
+	cl.Release(10*time.Millisecond, false)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("Acquire() after a release: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire() was not woken up by Release()")
+	}
+
+	if got := cl.InFlight(); got != 2 {
+		t.Errorf("InFlight() = %d, want 2", got)
+	}
+}
+
+func TestConcurrencyLimiterLimit(t *testing.T) {
+	type release struct {
+		// saturated fills every slot before releasing one.
+		saturated bool
+		latency   time.Duration
+		failed    bool
+	}
+
+	ok := release{latency: 10 * time.Millisecond}
+	saturatedOK := release{saturated: true, latency: 10 * time.Millisecond}
+	failed := release{latency: 10 * time.Millisecond, failed: true}
+	slow := release{latency: 30 * time.Millisecond}
+
+	tests := []struct {
+		name     string
+		initial  int
+		min      int
+		releases []release
+		want     int
+	}{
+		{name: "initial limit", initial: 4, min: 1, want: 4},
+		{name: "initial clamped to max", initial: 10, min: 1, want: 5},
+		{name: "initial clamped to min", initial: 1, min: 2, want: 2},
+		{name: "first success sets the baseline", initial: 4, min: 1, releases: []release{ok}, want: 4},
+		{name: "failure backs off", initial: 4, min: 1, releases: []release{failed}, want: 2},
+		{name: "back off stops at min", initial: 5, min: 3, releases: []release{failed}, want: 3},
+		{name: "one back off per batch", initial: 4, min: 1, releases: []release{failed, failed}, want: 2},
+		{name: "latency rise backs off", initial: 4, min: 1, releases: []release{ok, slow}, want: 2},
+		{name: "idle limit does not grow", initial: 4, min: 1, releases: []release{ok, ok, ok, ok, ok, ok}, want: 4},
+		{name: "saturated limit grows up to max", initial: 4, min: 1, releases: []release{ok, saturatedOK, saturatedOK, saturatedOK, saturatedOK, saturatedOK, saturatedOK}, want: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := NewConcurrencyLimiter(ConcurrencyConfig{Initial: tt.initial, Min: tt.min, Max: 5, Tolerance: 1.5, Backoff: 0.5})
+
+			for _, r := range tt.releases {
+				for cl.InFlight() == 0 || (r.saturated && cl.InFlight() < cl.Limit()) {
+					if err := cl.Acquire(context.Background()); err != nil {
+						t.Fatalf("Acquire(): %v", err)
+					}
+				}
+				cl.Release(r.latency, r.failed)
+			}
+
+			if got := cl.Limit(); got != tt.want {
+				t.Errorf("Limit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
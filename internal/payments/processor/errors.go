@@ -0,0 +1,105 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+type ErrorKind int
+
+const (
+	// ErrorRetryable means the processor did not take the payment and the call
+	// can safely be repeated on any gateway.
+	ErrorRetryable ErrorKind = iota
+	// ErrorPermanent means the processor rejected the payment itself, so
+	// repeating the call cannot succeed.
+	ErrorPermanent
+	// ErrorAmbiguous means the request may have reached the processor but its
+	// outcome is unknown, e.g. a timeout after the request was sent.
+	ErrorAmbiguous
+	// ErrorDuplicate means the processor already knows the correlationId.
+	ErrorDuplicate
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorRetryable:
+		return "retryable"
+	case ErrorPermanent:
+		return "permanent"
+	case ErrorAmbiguous:
+		return "ambiguous"
+	case ErrorDuplicate:
+		return "duplicate"
+	default:
+		return "unknown"
+	}
+}
+
+type GatewayError struct {
+	Kind       ErrorKind
+	Gateway    string
+	StatusCode int
+	Err        error
+}
+
+func (e *GatewayError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s error from %s gateway (HTTP %d): %v", e.Kind, e.Gateway, e.StatusCode, e.Err)
+	}
+
+	return fmt.Sprintf("%s error calling %s gateway: %v", e.Kind, e.Gateway, e.Err)
+}
+
+func (e *GatewayError) Unwrap() error {
+	return e.Err
+}
+
+func ErrorKindOf(err error) (ErrorKind, bool) {
+	var gatewayErr *GatewayError
+	if errors.As(err, &gatewayErr) {
+		return gatewayErr.Kind, true
+	}
+
+	return ErrorRetryable, false
+}
+
+func classifyStatusCode(statusCode int) ErrorKind {
+	switch {
+	case statusCode == http.StatusUnprocessableEntity:
+		return ErrorDuplicate
+	case statusCode == http.StatusRequestTimeout, statusCode == http.StatusTooManyRequests:
+		return ErrorRetryable
+	case statusCode == http.StatusGatewayTimeout:
+		return ErrorAmbiguous
+	case statusCode >= 400 && statusCode < 500:
+		return ErrorPermanent
+	default:
+		return ErrorRetryable
+	}
+}
+
+// classifyTransportError separates failures that happened before the request
+// left this process (safe to retry) from those after it may have been
+// delivered (ambiguous).
+func classifyTransportError(err error) ErrorKind {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrorRetryable
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return ErrorRetryable
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ErrorRetryable
+	}
+
+	// Timeouts, cancellations and connections dropped mid-request.
+	return ErrorAmbiguous
+}
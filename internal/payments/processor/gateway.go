@@ -8,40 +8,102 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/vrtineu/payments-proxy/internal/payments"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type PaymentGateway struct {
 	url         string
 	gatewayType payments.GatewayType
+	priority    int
+	fee         payments.FeeRate
 	client      *http.Client
+	stats       *gatewayStats
+	breaker     *CircuitBreaker
+	limiter     *ConcurrencyLimiter
+	rateLimiter *RateLimiter
 }
 
 const (
 	HealthCheckEndpoint        = "/payments/service-health"
 	ProcessPaymentEndpoint     = "/payments"
+	LookupPaymentEndpoint      = "/payments/"
 	ServiceUnavailableResponse = `{"failing":true,"minResponseTime":0}`
 )
 
-func NewPaymentGateway(url string, gatewayType payments.GatewayType) *PaymentGateway {
+var ErrPaymentNotFound = errors.New("payment not found in processor")
+
+// GatewayOptions are the settings shared by every gateway in the registry.
+type GatewayOptions struct {
+	Circuit     CircuitBreakerConfig
+	Concurrency ConcurrencyConfig
+	Client      HTTPClientConfig
+}
+
+type HTTPClientConfig struct {
+	Timeout         time.Duration
+	MaxIdleConns    int
+	IdleConnTimeout time.Duration
+}
+
+func NewPaymentGateway(rdb *redis.Client, config GatewayConfig, opts GatewayOptions) *PaymentGateway {
+	limiter := NewConcurrencyLimiter(opts.Concurrency)
+
 	return &PaymentGateway{
-		url:         url,
-		gatewayType: gatewayType,
+		url:         config.URL,
+		gatewayType: payments.GatewayType(config.Name),
+		priority:    config.Priority,
+		fee:         config.Fee,
+		stats:       &gatewayStats{},
+		breaker:     NewCircuitBreaker(opts.Circuit),
+		limiter:     limiter,
+		rateLimiter: NewRateLimiter(rdb, config.Name, config.RateLimit, config.Burst),
 		client: &http.Client{
-			Timeout: 10 * time.Second,
-			Transport: &http.Transport{
-				MaxIdleConns:        256,
-				MaxIdleConnsPerHost: 128,
-				MaxConnsPerHost:     128,
-				IdleConnTimeout:     30 * time.Second,
+			Timeout: opts.Client.Timeout,
+			// The limiter bounds the calls in flight; the transport only has to
+			// keep up with its largest limit.
+			Transport: otelhttp.NewTransport(&http.Transport{
+				MaxIdleConns:        opts.Client.MaxIdleConns,
+				MaxIdleConnsPerHost: limiter.config.Max,
+				MaxConnsPerHost:     limiter.config.Max,
+				IdleConnTimeout:     opts.Client.IdleConnTimeout,
 				DisableCompression:  true,
-			},
+			}, otelhttp.WithFilter(isTraced)),
 		},
 	}
 }
 
+// isTraced keeps calls made outside of a payment's trace, such as health
+// checks, from each starting a trace of their own.
+func isTraced(r *http.Request) bool {
+	return trace.SpanContextFromContext(r.Context()).IsValid()
+}
+
+func (pg *PaymentGateway) Name() string {
+	return pg.gatewayType.String()
+}
+
+func (pg *PaymentGateway) Fee() payments.FeeRate {
+	return pg.fee
+}
+
+func (pg *PaymentGateway) CircuitState() CircuitState {
+	return pg.breaker.State()
+}
+
+func (pg *PaymentGateway) Metrics() GatewayMetrics {
+	metrics := pg.stats.Snapshot()
+	metrics.ConcurrencyLimit = pg.limiter.Limit()
+	metrics.InFlight = pg.limiter.InFlight()
+
+	return metrics
+}
+
 func (pg *PaymentGateway) HealthCheck(ctx context.Context) ([]byte, error) {
 	// Verifica as condições de funcionamento do endpoint de pagamentos. Limite de 1 chamada a cada 5 segundos.
 	// GET /payments/service-health
@@ -90,25 +152,72 @@ func (pg *PaymentGateway) ProcessPayment(ctx context.Context, payment *payments.
 
 	paymentData, err := json.Marshal(payment)
 	if err != nil {
-		return err
+		return pg.newError(ErrorPermanent, 0, err)
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "POST", pg.url+ProcessPaymentEndpoint, bytes.NewBuffer(paymentData))
 	if err != nil {
-		return err
+		return pg.newError(ErrorPermanent, 0, err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
+	resp, err := pg.client.Do(req)
+	if err != nil {
+		return pg.newError(classifyTransportError(err), 0, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return pg.newError(classifyStatusCode(resp.StatusCode), resp.StatusCode, fmt.Errorf("failed to process payment: %s, body: %s", resp.Status, body))
+	}
+
+	return nil
+}
+
+func (pg *PaymentGateway) newError(kind ErrorKind, statusCode int, err error) *GatewayError {
+	return &GatewayError{
+		Kind:       kind,
+		Gateway:    pg.gatewayType.String(),
+		StatusCode: statusCode,
+		Err:        err,
+	}
+}
+
+// LookupPayment confirms that the processor has the payment. Only whether it
+// exists is used: the payment is recorded as it was sent, with the fee rate
+// captured then.
+func (pg *PaymentGateway) LookupPayment(ctx context.Context, correlationID string) error {
+	// Consulta um pagamento já processado.
+	// GET /payments/{id}
+	// HTTP 200 - Ok
+	// {
+	// 	"correlationId": "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3",
+	// 	"amount": 19.90,
+	// 	"requestedAt" : "2025-07-15T12:34:56.000Z"
+	// }
+
+	req, err := http.NewRequestWithContext(ctx, "GET", pg.url+LookupPaymentEndpoint+url.PathEscape(correlationID), nil)
+	if err != nil {
+		return err
+	}
+
 	resp, err := pg.client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrPaymentNotFound
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to process payment: %s, body: %s", resp.Status, body)
+		return fmt.Errorf("failed to look up payment: %s, body: %s", resp.Status, body)
 	}
 
-	return nil
+	// The body is drained so that the connection is reused.
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
 }
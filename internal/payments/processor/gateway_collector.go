@@ -0,0 +1,73 @@
+package processor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vrtineu/payments-proxy/internal/metrics"
+)
+
+var (
+	healthStates  = []HealthState{HealthUnknown, HealthHealthy, HealthFailing}
+	circuitStates = []CircuitState{CircuitClosed, CircuitOpen, CircuitHalfOpen}
+)
+
+// GatewayCollector reports the state this instance holds about each gateway:
+// health, circuit, concurrency limit and observed latency.
+type GatewayCollector struct {
+	registry      *GatewayRegistry
+	healthChecker *HealthChecker
+
+	health           *prometheus.Desc
+	circuit          *prometheus.Desc
+	concurrencyLimit *prometheus.Desc
+	inFlight         *prometheus.Desc
+	latency          *prometheus.Desc
+}
+
+func NewGatewayCollector(registry *GatewayRegistry, healthChecker *HealthChecker) *GatewayCollector {
+	return &GatewayCollector{
+		registry:         registry,
+		healthChecker:    healthChecker,
+		health:           prometheus.NewDesc(metrics.Namespace+"_gateway_health", "1 for the current health state of the gateway.", []string{"gateway", "state"}, nil),
+		circuit:          prometheus.NewDesc(metrics.Namespace+"_gateway_circuit", "1 for the current circuit breaker state of the gateway.", []string{"gateway", "state"}, nil),
+		concurrencyLimit: prometheus.NewDesc(metrics.Namespace+"_gateway_concurrency_limit", "Calls currently allowed in flight to the gateway.", []string{"gateway"}, nil),
+		inFlight:         prometheus.NewDesc(metrics.Namespace+"_gateway_in_flight", "Calls in flight to the gateway.", []string{"gateway"}, nil),
+		latency:          prometheus.NewDesc(metrics.Namespace+"_gateway_latency_seconds", "Observed latency of the gateway by quantile, cluster-wide when available.", []string{"gateway", "quantile"}, nil),
+	}
+}
+
+func (c *GatewayCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.health
+	ch <- c.circuit
+	ch <- c.concurrencyLimit
+	ch <- c.inFlight
+	ch <- c.latency
+}
+
+func (c *GatewayCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, gateway := range c.registry.All() {
+		name := gateway.Name()
+
+		health := c.healthChecker.State(gateway)
+		for _, state := range healthStates {
+			ch <- prometheus.MustNewConstMetric(c.health, prometheus.GaugeValue, boolValue(state == health), name, string(state))
+		}
+
+		circuit := gateway.CircuitState()
+		for _, state := range circuitStates {
+			ch <- prometheus.MustNewConstMetric(c.circuit, prometheus.GaugeValue, boolValue(state == circuit), name, state.String())
+		}
+
+		observed := gateway.Metrics()
+		ch <- prometheus.MustNewConstMetric(c.concurrencyLimit, prometheus.GaugeValue, float64(observed.ConcurrencyLimit), name)
+		ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue, float64(observed.InFlight), name)
+		ch <- prometheus.MustNewConstMetric(c.latency, prometheus.GaugeValue, observed.MedianLatency().Seconds(), name, "0.5")
+		ch <- prometheus.MustNewConstMetric(c.latency, prometheus.GaugeValue, observed.TailLatency().Seconds(), name, "0.99")
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
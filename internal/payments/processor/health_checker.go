@@ -4,43 +4,119 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/vrtineu/payments-proxy/internal/logging"
 	"github.com/vrtineu/payments-proxy/internal/payments"
 )
 
 type HealthChecker struct {
-	rdb             *redis.Client
-	instanceID      string
-	localCache      map[payments.GatewayType]*HealthStatus
-	lastUpdate      map[payments.GatewayType]time.Time
-	mu              sync.RWMutex
-	defaultGateway  *PaymentGateway
-	fallbackGateway *PaymentGateway
+	rdb        *redis.Client
+	instanceID string
+	config     HealthCheckerConfig
+	localCache map[payments.GatewayType]*HealthStatus
+	lastUpdate map[payments.GatewayType]time.Time
+	states     map[payments.GatewayType]HealthState
+	history    map[payments.GatewayType][]HealthTransition
+	mu         sync.RWMutex
+	registry   *GatewayRegistry
+}
+
+type HealthCheckerConfig struct {
+	// Interval is how often leases are attempted and staleness is evaluated.
+	Interval time.Duration
+	// LeaseDuration spaces the checks of one gateway; processors allow one
+	// health check every 5 seconds.
+	LeaseDuration time.Duration
+	StatusTTL     time.Duration
+	// StaleAfter is how long a status is trusted without being refreshed.
+	StaleAfter  time.Duration
+	StalePolicy StalePolicy
+	HistorySize int
+}
+
+// StalePolicy decides how routing sees a gateway whose health is unknown,
+// either because no status was received yet or because it went stale.
+type StalePolicy int
+
+const (
+	// StaleAsFailing keeps the gateway out of routing.
+	StaleAsFailing StalePolicy = iota
+	// StaleAsHealthy routes to the gateway and leaves it to the circuit
+	// breaker and observed latency.
+	StaleAsHealthy
+	// StaleKeepLast keeps using the last status received, if any.
+	StaleKeepLast
+)
+
+func ParseStalePolicy(value string) (StalePolicy, error) {
+	switch value {
+	case "", "failing":
+		return StaleAsFailing, nil
+	case "healthy":
+		return StaleAsHealthy, nil
+	case "keep":
+		return StaleKeepLast, nil
+	default:
+		return StaleAsFailing, fmt.Errorf("unknown stale health policy %q", value)
+	}
+}
+
+type HealthState string
+
+const (
+	HealthUnknown HealthState = "unknown"
+	HealthHealthy HealthState = "healthy"
+	HealthFailing HealthState = "failing"
+)
+
+const healthChannel = "processor:health"
+
+// HealthCheckRateLimit is the shortest interval between health checks of a
+// gateway the processors accept; faster checks are answered with errors.
+const HealthCheckRateLimit = 5 * time.Second
+
+// healthUpdate is published and stored by the instance holding a gateway's
+// lease after every health check. CheckedAt dates the status wherever it is
+// received, so a stored copy is only trusted for what is left of StaleAfter.
+type healthUpdate struct {
+	Gateway   string          `json:"gateway"`
+	Status    json.RawMessage `json:"status"`
+	Reason    string          `json:"reason,omitempty"`
+	CheckedAt time.Time       `json:"checkedAt"`
 }
 
 type HealthStatus struct {
 	Failing         bool  `json:"failing"`
 	MinResponseTime int64 `json:"minResponseTime"`
+	// Unknown is set when the status was derived from the stale policy rather
+	// than from a fresh health check.
+	Unknown bool `json:"-"`
 }
 
-func NewHealthChecker(rdb *redis.Client, defaultGateway, fallbackGateway *PaymentGateway) *HealthChecker {
-	instanceID := os.Getenv("HOSTNAME")
-	if instanceID == "" {
-		instanceID = fmt.Sprintf("proc-%d", os.Getpid())
+// InstanceID identifies this process among the instances sharing Redis.
+func InstanceID() string {
+	if hostname := os.Getenv("HOSTNAME"); hostname != "" {
+		return hostname
 	}
 
+	return fmt.Sprintf("proc-%d", os.Getpid())
+}
+
+func NewHealthChecker(rdb *redis.Client, registry *GatewayRegistry, config HealthCheckerConfig) *HealthChecker {
 	return &HealthChecker{
-		rdb:             rdb,
-		instanceID:      instanceID,
-		localCache:      make(map[payments.GatewayType]*HealthStatus),
-		lastUpdate:      make(map[payments.GatewayType]time.Time),
-		defaultGateway:  defaultGateway,
-		fallbackGateway: fallbackGateway,
+		rdb:        rdb,
+		instanceID: InstanceID(),
+		config:     config,
+		localCache: make(map[payments.GatewayType]*HealthStatus),
+		lastUpdate: make(map[payments.GatewayType]time.Time),
+		states:     make(map[payments.GatewayType]HealthState),
+		history:    make(map[payments.GatewayType][]HealthTransition),
+		registry:   registry,
 	}
 }
 
@@ -49,17 +125,37 @@ func (hc *HealthChecker) GetHealthStatus(ctx context.Context, gateway *PaymentGa
 	defer hc.mu.RUnlock()
 
 	status, exists := hc.localCache[gateway.gatewayType]
-	if !exists {
-		return &HealthStatus{Failing: true, MinResponseTime: 0}, nil
+	if exists && hc.states[gateway.gatewayType] != HealthUnknown {
+		return status, nil
 	}
 
-	return status, nil
+	switch {
+	case hc.config.StalePolicy == StaleAsHealthy:
+		return &HealthStatus{Failing: false, MinResponseTime: 0, Unknown: true}, nil
+	case hc.config.StalePolicy == StaleKeepLast && exists:
+		return &HealthStatus{Failing: status.Failing, MinResponseTime: status.MinResponseTime, Unknown: true}, nil
+	default:
+		return &HealthStatus{Failing: true, MinResponseTime: 0, Unknown: true}, nil
+	}
+}
+
+// State is the health state of the gateway as this instance last saw it.
+func (hc *HealthChecker) State(gateway *PaymentGateway) HealthState {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	if state, ok := hc.states[gateway.gatewayType]; ok {
+		return state
+	}
+	return HealthUnknown
 }
 
 func (hc *HealthChecker) StartHealthMonitor(ctx context.Context) {
 	hc.initializeCache()
 
-	ticker := time.NewTicker(1 * time.Second)
+	go hc.subscribeHealthUpdates(ctx)
+
+	ticker := time.NewTicker(hc.config.Interval)
 	go func() {
 		defer ticker.Stop()
 		for {
@@ -77,56 +173,113 @@ func (hc *HealthChecker) initializeCache() {
 	hc.mu.Lock()
 	defer hc.mu.Unlock()
 
-	hc.localCache[payments.Default] = &HealthStatus{Failing: true, MinResponseTime: 0}
-	hc.localCache[payments.Fallback] = &HealthStatus{Failing: true, MinResponseTime: 0}
+	for _, gateway := range hc.registry.All() {
+		hc.states[gateway.gatewayType] = HealthUnknown
+	}
+}
+
+func (hc *HealthChecker) subscribeHealthUpdates(ctx context.Context) {
+	pubsub := hc.rdb.Subscribe(ctx, healthChannel)
+	defer pubsub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-pubsub.Channel():
+			if !ok {
+				return
+			}
+
+			var update healthUpdate
+			if err := json.Unmarshal([]byte(msg.Payload), &update); err != nil {
+				slog.Error("decoding health update", logging.Err(err))
+				continue
+			}
+
+			gateway := hc.registry.Get(update.Gateway)
+			if gateway == nil {
+				continue
+			}
+			hc.updateLocalCache(gateway.gatewayType, update)
+		}
+	}
 }
 
 func (hc *HealthChecker) checkAndUpdateHealth(ctx context.Context) {
-	gateways := []payments.GatewayType{payments.Default, payments.Fallback}
+	for _, gateway := range hc.registry.All() {
+		sinceUpdate := hc.sinceLastUpdate(gateway.gatewayType)
+		if sinceUpdate >= hc.config.StaleAfter {
+			hc.markStale(gateway.gatewayType, sinceUpdate)
+		}
 
-	for _, gw := range gateways {
-		if hc.shouldPerformHealthCheck(ctx, gw) {
-			go hc.performHealthCheckWithLease(ctx, gw)
+		// A status heard within the lease duration means another instance
+		// still holds the lease, so there is no point in trying to take it.
+		if sinceUpdate < hc.config.LeaseDuration {
+			continue
 		}
 
-		hc.refreshLocalCache(ctx, gw)
+		if hc.shouldPerformHealthCheck(ctx, gateway.gatewayType) {
+			go hc.performHealthCheckWithLease(ctx, gateway)
+			continue
+		}
+
+		// Statuses normally arrive through healthChannel; Redis is only polled
+		// when nothing was heard about the gateway for two leases.
+		if sinceUpdate >= 2*hc.config.LeaseDuration {
+			hc.refreshLocalCache(ctx, gateway.gatewayType)
+		}
 	}
 }
 
+func (hc *HealthChecker) sinceLastUpdate(gateway payments.GatewayType) time.Duration {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	return time.Since(hc.lastUpdate[gateway])
+}
+
 func (hc *HealthChecker) shouldPerformHealthCheck(ctx context.Context, gateway payments.GatewayType) bool {
 	leaseKey := fmt.Sprintf("health:lease:%s", gateway.String())
 
-	acquired, err := hc.rdb.SetNX(ctx, leaseKey, hc.instanceID, 6*time.Second).Result()
+	acquired, err := hc.rdb.SetNX(ctx, leaseKey, hc.instanceID, hc.config.LeaseDuration).Result()
 	if err != nil {
-		log.Printf("Error acquiring lease for %s: %v", gateway.String(), err)
+		slog.Error("acquiring health check lease", logging.Err(err), logging.GatewayKey, gateway.String())
 		return false
 	}
 
 	return acquired
 }
 
-func (hc *HealthChecker) performHealthCheckWithLease(ctx context.Context, gateway payments.GatewayType) {
-	var pg *PaymentGateway
-	if gateway == payments.Default {
-		pg = hc.defaultGateway
-	} else {
-		pg = hc.fallbackGateway
-	}
-
+func (hc *HealthChecker) performHealthCheckWithLease(ctx context.Context, pg *PaymentGateway) {
+	gateway := pg.gatewayType
 	healthBytes, err := pg.HealthCheck(ctx)
 
 	key := fmt.Sprintf("processor:%s:health", gateway.String())
 
-	if err == nil {
-		if setErr := hc.rdb.Set(ctx, key, healthBytes, 15*time.Second).Err(); setErr != nil {
-			log.Printf("Error saving health status for %s: %v", gateway.String(), setErr)
-		}
-		hc.updateLocalCacheFromBytes(gateway, healthBytes)
-	} else {
-		log.Printf("Health check failed for %s: %v", gateway.String(), err)
-		failingStatus := `{"failing":true,"minResponseTime":0}`
-		hc.rdb.Set(ctx, key, failingStatus, 15*time.Second)
-		hc.updateLocalCacheFromBytes(gateway, []byte(failingStatus))
+	reason := ""
+	if err != nil {
+		slog.Warn("health check failed", logging.Err(err), logging.GatewayKey, gateway.String())
+		healthBytes = []byte(ServiceUnavailableResponse)
+		reason = fmt.Sprintf("health check failed: %v", err)
+	}
+
+	update := healthUpdate{Gateway: gateway.String(), Status: healthBytes, Reason: reason, CheckedAt: time.Now()}
+	hc.updateLocalCache(gateway, update)
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		slog.Error("encoding health update", logging.Err(err), logging.GatewayKey, gateway.String())
+		return
+	}
+
+	// The stored copy serves instances that missed the published update.
+	if setErr := hc.rdb.Set(ctx, key, data, hc.config.StatusTTL).Err(); setErr != nil {
+		slog.Error("saving health status", logging.Err(setErr), logging.GatewayKey, gateway.String())
+	}
+
+	if pubErr := hc.rdb.Publish(ctx, healthChannel, data).Err(); pubErr != nil {
+		slog.Error("publishing health status", logging.Err(pubErr), logging.GatewayKey, gateway.String())
 	}
 }
 
@@ -134,24 +287,92 @@ func (hc *HealthChecker) refreshLocalCache(ctx context.Context, gateway payments
 	key := fmt.Sprintf("processor:%s:health", gateway.String())
 
 	val, err := hc.rdb.Get(ctx, key).Result()
-	if err == nil {
-		hc.updateLocalCacheFromBytes(gateway, []byte(val))
-	} else if err != redis.Nil {
-		log.Printf("Error refreshing cache for %s: %v", gateway.String(), err)
+	if err == redis.Nil {
+		return
+	}
+	if err != nil {
+		slog.Error("refreshing health status", logging.Err(err), logging.GatewayKey, gateway.String())
+		return
+	}
+
+	var update healthUpdate
+	if err := json.Unmarshal([]byte(val), &update); err != nil {
+		slog.Error("decoding stored health status", logging.Err(err), logging.GatewayKey, gateway.String())
+		return
 	}
+	hc.updateLocalCache(gateway, update)
 }
 
-func (hc *HealthChecker) updateLocalCacheFromBytes(gateway payments.GatewayType, data []byte) {
+// updateLocalCache applies a status dated by when it was checked, ignoring
+// statuses older than the one already applied or already stale.
+func (hc *HealthChecker) updateLocalCache(gateway payments.GatewayType, update healthUpdate) {
 	hc.mu.Lock()
 	defer hc.mu.Unlock()
 
+	checkedAt := update.CheckedAt
+	if !checkedAt.After(hc.lastUpdate[gateway]) || time.Since(checkedAt) >= hc.config.StaleAfter {
+		return
+	}
+
+	reason := update.Reason
 	status := &HealthStatus{}
-	if err := json.Unmarshal(data, status); err != nil {
-		log.Printf("Error unmarshaling health status for %s: %v", gateway.String(), err)
+	if err := json.Unmarshal(update.Status, status); err != nil {
+		slog.Error("decoding health status", logging.Err(err), logging.GatewayKey, gateway.String())
 		status.Failing = true
 		status.MinResponseTime = 0
+		reason = fmt.Sprintf("invalid health status: %v", err)
+	}
+
+	state := HealthHealthy
+	if status.Failing {
+		state = HealthFailing
+		if reason == "" {
+			reason = "processor reported failing"
+		}
 	}
 
 	hc.localCache[gateway] = status
-	hc.lastUpdate[gateway] = time.Now()
+	hc.lastUpdate[gateway] = checkedAt
+	hc.transition(gateway, state, checkedAt, status.MinResponseTime, reason)
+}
+
+func (hc *HealthChecker) markStale(gateway payments.GatewayType, sinceUpdate time.Duration) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if hc.states[gateway] == HealthUnknown {
+		return
+	}
+
+	reason := fmt.Sprintf("no health status for %s", sinceUpdate.Round(time.Second))
+	hc.transition(gateway, HealthUnknown, time.Now(), 0, reason)
+}
+
+// transition records a change of state in the gateway's history, keeping only
+// the most recent HistorySize entries. Must be called with mu held.
+func (hc *HealthChecker) transition(gateway payments.GatewayType, state HealthState, at time.Time, minResponseTime int64, reason string) {
+	from, known := hc.states[gateway]
+	if !known {
+		from = HealthUnknown
+	}
+	if from == state {
+		return
+	}
+
+	hc.states[gateway] = state
+	if hc.config.HistorySize <= 0 {
+		return
+	}
+
+	history := append(hc.history[gateway], HealthTransition{
+		At:              at,
+		From:            from,
+		To:              state,
+		MinResponseTime: minResponseTime,
+		Reason:          reason,
+	})
+	if len(history) > hc.config.HistorySize {
+		history = history[len(history)-hc.config.HistorySize:]
+	}
+	hc.history[gateway] = history
 }
@@ -0,0 +1,73 @@
+package processor
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/vrtineu/payments-proxy/internal/payments"
+)
+
+type HealthTransition struct {
+	At              time.Time   `json:"at"`
+	From            HealthState `json:"from"`
+	To              HealthState `json:"to"`
+	MinResponseTime int64       `json:"minResponseTime"`
+	Reason          string      `json:"reason,omitempty"`
+}
+
+// GatewayHealthReport is what this instance knows about a gateway's health,
+// including the transitions it witnessed, most recent last.
+type GatewayHealthReport struct {
+	Gateway         string             `json:"gateway"`
+	State           HealthState        `json:"state"`
+	Failing         bool               `json:"failing"`
+	MinResponseTime int64              `json:"minResponseTime"`
+	UpdatedAt       *time.Time         `json:"updatedAt,omitempty"`
+	History         []HealthTransition `json:"history"`
+}
+
+func (hc *HealthChecker) HealthReport() []GatewayHealthReport {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	gateways := hc.registry.All()
+	reports := make([]GatewayHealthReport, len(gateways))
+	for i, gateway := range gateways {
+		report := GatewayHealthReport{
+			Gateway: gateway.Name(),
+			State:   hc.states[gateway.gatewayType],
+			History: slices.Clone(hc.history[gateway.gatewayType]),
+		}
+		if report.State == "" {
+			report.State = HealthUnknown
+		}
+		if report.History == nil {
+			report.History = []HealthTransition{}
+		}
+
+		if status, ok := hc.localCache[gateway.gatewayType]; ok {
+			report.Failing = status.Failing
+			report.MinResponseTime = status.MinResponseTime
+		}
+		if updatedAt, ok := hc.lastUpdate[gateway.gatewayType]; ok {
+			report.UpdatedAt = &updatedAt
+		}
+
+		reports[i] = report
+	}
+
+	return reports
+}
+
+func (hc *HealthChecker) HealthReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		payments.WriteError(w, http.StatusMethodNotAllowed, payments.ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(hc.HealthReport())
+}
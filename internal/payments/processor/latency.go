@@ -0,0 +1,124 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vrtineu/payments-proxy/internal/logging"
+)
+
+// Samples older than this are left out of the cluster view and deleted; they
+// belong to an instance that stopped publishing.
+const latencySampleMaxAge = 2 * latencyWindow
+
+type latencySample struct {
+	Counts    []int64 `json:"counts"`
+	UpdatedAt int64   `json:"updatedAt"`
+}
+
+// LatencyPublisher shares the latency histograms observed by this instance and
+// merges those of every instance, so routing decisions are based on all the
+// calls made to a gateway rather than on the few made locally.
+type LatencyPublisher struct {
+	rdb        *redis.Client
+	registry   *GatewayRegistry
+	instanceID string
+}
+
+func NewLatencyPublisher(rdb *redis.Client, registry *GatewayRegistry, instanceID string) *LatencyPublisher {
+	return &LatencyPublisher{
+		rdb:        rdb,
+		registry:   registry,
+		instanceID: instanceID,
+	}
+}
+
+func (lp *LatencyPublisher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := lp.publish(ctx); err != nil {
+				slog.Error("publishing gateway latency", logging.Err(err))
+			}
+		}
+	}
+}
+
+func (lp *LatencyPublisher) publish(ctx context.Context) error {
+	gateways := lp.registry.All()
+	cmds := make([]*redis.MapStringStringCmd, len(gateways))
+	now := time.Now()
+
+	_, err := lp.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, gateway := range gateways {
+			histogram := gateway.stats.windowHistogram()
+			data, err := json.Marshal(latencySample{
+				Counts:    histogram.counts[:],
+				UpdatedAt: now.UnixMilli(),
+			})
+			if err != nil {
+				return err
+			}
+
+			key := latencyKey(gateway.Name())
+			pipe.HSet(ctx, key, lp.instanceID, data)
+			pipe.PExpire(ctx, key, latencySampleMaxAge)
+			cmds[i] = pipe.HGetAll(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	stale := make(map[string][]string)
+	for i, gateway := range gateways {
+		var cluster latencyHistogram
+		for instanceID, value := range cmds[i].Val() {
+			var sample latencySample
+			if err := json.Unmarshal([]byte(value), &sample); err != nil || now.Sub(time.UnixMilli(sample.UpdatedAt)) > latencySampleMaxAge {
+				stale[latencyKey(gateway.Name())] = append(stale[latencyKey(gateway.Name())], instanceID)
+				continue
+			}
+			if len(sample.Counts) != len(cluster.counts) {
+				continue
+			}
+
+			for j, count := range sample.Counts {
+				cluster.counts[j] += count
+				cluster.total += count
+			}
+		}
+
+		gateway.stats.SetClusterLatency(quantile(0.5, &cluster), quantile(0.99, &cluster))
+	}
+
+	if len(stale) == 0 {
+		return nil
+	}
+
+	// Every instance restart or scale event leaves a field behind. Should one
+	// be refreshed meanwhile, it is deleted all the same and comes back with
+	// its instance's next publish.
+	_, err = lp.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, fields := range stale {
+			pipe.HDel(ctx, key, fields...)
+		}
+		return nil
+	})
+
+	return err
+}
+
+func latencyKey(gateway string) string {
+	return fmt.Sprintf("gateway:latency:%s", gateway)
+}
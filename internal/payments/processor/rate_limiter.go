@@ -0,0 +1,161 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vrtineu/payments-proxy/internal/logging"
+)
+
+// Tokens leased from the shared bucket are only valid for this long, so an
+// instance cannot hoard a burst and spend it after the quota has moved on.
+const rateLimitLease = 50 * time.Millisecond
+
+// Refills the bucket by the elapsed Redis time and grants up to ARGV[3] tokens.
+// Returns the tokens granted and, when none were, the milliseconds until the
+// next one is available.
+var leaseTokensScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local requested = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+local granted = math.min(requested, math.floor(tokens))
+tokens = tokens - granted
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+local wait = 0
+if granted == 0 then
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+return {granted, wait}
+`)
+
+// RateLimiter enforces a gateway's request quota across every instance with a
+// token bucket kept in Redis. Tokens are leased in small batches so most calls
+// are admitted without a round trip to Redis.
+type RateLimiter struct {
+	rdb   *redis.Client
+	key   string
+	rate  float64
+	burst int
+	lease int
+
+	mu           sync.Mutex
+	tokens       int
+	expiresAt    time.Time
+	blockedUntil time.Time
+}
+
+// NewRateLimiter returns nil when rate is not positive; a nil limiter admits
+// every call.
+func NewRateLimiter(rdb *redis.Client, gateway string, rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst <= 0 {
+		burst = max(int(math.Ceil(rate)), 1)
+	}
+
+	return &RateLimiter{
+		rdb:   rdb,
+		key:   rateLimitKey(gateway),
+		rate:  rate,
+		burst: burst,
+		lease: min(max(int(rate*rateLimitLease.Seconds()), 1), burst),
+	}
+}
+
+// Wait blocks until a token is available, returning at once with
+// context.DeadlineExceeded when the next token would come after ctx's
+// deadline. When Redis cannot be reached the call is admitted, since the
+// processor is a better judge of its quota than a stalled worker.
+func (rl *RateLimiter) Wait(ctx context.Context) error {
+	if rl == nil {
+		return nil
+	}
+
+	for {
+		wait, err := rl.take(ctx)
+		if err != nil {
+			slog.Warn("leasing rate limit tokens, letting the call through", logging.Err(err), "key", rl.key)
+			return nil
+		}
+		if wait == 0 {
+			return nil
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return context.DeadlineExceeded
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Saturated reports whether the shared bucket was found empty and has not
+// refilled yet, without asking Redis.
+func (rl *RateLimiter) Saturated() bool {
+	if rl == nil {
+		return false
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	return (rl.tokens == 0 || !now.Before(rl.expiresAt)) && now.Before(rl.blockedUntil)
+}
+
+// take spends a leased token, leasing more when none are left. It returns how
+// long to wait before trying again when the bucket is empty.
+func (rl *RateLimiter) take(ctx context.Context) (time.Duration, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if rl.tokens > 0 && now.Before(rl.expiresAt) {
+		rl.tokens--
+		return 0, nil
+	}
+
+	if now.Before(rl.blockedUntil) {
+		return rl.blockedUntil.Sub(now), nil
+	}
+
+	result, err := leaseTokensScript.Run(ctx, rl.rdb, []string{rl.key}, rl.rate, rl.burst, rl.lease).Int64Slice()
+	if err != nil {
+		return 0, err
+	}
+
+	granted, waitMs := result[0], result[1]
+	if granted == 0 {
+		wait := max(time.Duration(waitMs)*time.Millisecond, time.Millisecond)
+		rl.tokens = 0
+		rl.blockedUntil = now.Add(wait)
+		return wait, nil
+	}
+
+	rl.tokens = int(granted) - 1
+	rl.expiresAt = now.Add(rateLimitLease)
+	return 0, nil
+}
+
+func rateLimitKey(gateway string) string {
+	return fmt.Sprintf("gateway:ratelimit:%s", gateway)
+}
@@ -0,0 +1,116 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vrtineu/payments-proxy/internal/payments"
+)
+
+type GatewayConfig struct {
+	Name     string           `json:"name" yaml:"name"`
+	URL      string           `json:"url" yaml:"url"`
+	Priority int              `json:"priority" yaml:"priority"`
+	Fee      payments.FeeRate `json:"fee" yaml:"fee"`
+	// RateLimit is the processor's quota in requests per second shared by all
+	// instances; zero leaves the gateway unlimited. Burst defaults to one
+	// second worth of requests.
+	RateLimit float64 `json:"rateLimit" yaml:"rateLimit"`
+	Burst     int     `json:"burst" yaml:"burst"`
+}
+
+// GatewayRegistry holds every configured payment processor ordered by
+// preference: lower priority first, then lower fee.
+type GatewayRegistry struct {
+	gateways []*PaymentGateway
+	byName   map[payments.GatewayType]*PaymentGateway
+}
+
+func ParseGatewayConfigs(data string) ([]GatewayConfig, error) {
+	var configs []GatewayConfig
+	if err := json.Unmarshal([]byte(data), &configs); err != nil {
+		return nil, fmt.Errorf("invalid gateway configuration: %w", err)
+	}
+
+	return configs, nil
+}
+
+func NewGatewayRegistry(rdb *redis.Client, configs []GatewayConfig, opts GatewayOptions) (*GatewayRegistry, error) {
+	if len(configs) == 0 {
+		return nil, errors.New("at least one gateway must be configured")
+	}
+
+	registry := &GatewayRegistry{
+		byName: make(map[payments.GatewayType]*PaymentGateway, len(configs)),
+	}
+
+	for _, config := range configs {
+		if !IsValidGatewayName(config.Name) {
+			return nil, fmt.Errorf("invalid gateway name %q: use lowercase letters, digits, '-' or '_'", config.Name)
+		}
+		if config.URL == "" {
+			return nil, fmt.Errorf("gateway %q has no url", config.Name)
+		}
+		if config.RateLimit < 0 || config.Burst < 0 {
+			return nil, fmt.Errorf("gateway %q has a negative rate limit", config.Name)
+		}
+
+		name := payments.GatewayType(config.Name)
+		if _, exists := registry.byName[name]; exists {
+			return nil, fmt.Errorf("gateway %q configured more than once", config.Name)
+		}
+
+		gateway := NewPaymentGateway(rdb, config, opts)
+		registry.gateways = append(registry.gateways, gateway)
+		registry.byName[name] = gateway
+	}
+
+	sort.SliceStable(registry.gateways, func(i, j int) bool {
+		a, b := registry.gateways[i], registry.gateways[j]
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		return a.fee < b.fee
+	})
+
+	return registry, nil
+}
+
+func (r *GatewayRegistry) All() []*PaymentGateway {
+	return r.gateways
+}
+
+func (r *GatewayRegistry) Get(name string) *PaymentGateway {
+	return r.byName[payments.GatewayType(name)]
+}
+
+func (r *GatewayRegistry) Infos() []payments.GatewayInfo {
+	infos := make([]payments.GatewayInfo, len(r.gateways))
+	for i, gateway := range r.gateways {
+		infos[i] = payments.GatewayInfo{
+			Name: gateway.gatewayType,
+			Fee:  gateway.fee,
+		}
+	}
+
+	return infos
+}
+
+// IsValidGatewayName reports whether name may name a gateway. Gateway names
+// end up in Redis keys and JSON field names.
+func IsValidGatewayName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,40 @@
+package processor
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+type RetryPolicy struct {
+	// MaxAttempts is the number of processor calls after which a payment is
+	// dead-lettered. Zero retries forever.
+	MaxAttempts int64
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// Delay returns the wait before the next attempt using exponential backoff with
+// equal jitter: half of the capped backoff is fixed and the other half random,
+// so retries of payments that failed together spread out instead of arriving
+// in synchronized waves.
+func (p RetryPolicy) Delay(attempt int64) time.Duration {
+	backoff := p.BaseDelay
+	for i := int64(1); i < attempt && backoff > 0 && backoff < p.MaxDelay; i++ {
+		backoff *= 2
+	}
+
+	if backoff <= 0 || backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+
+	half := backoff / 2
+	if half <= 0 {
+		return backoff
+	}
+
+	return half + rand.N(half)
+}
+
+func (p RetryPolicy) Exhausted(attempts int64) bool {
+	return p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
@@ -0,0 +1,63 @@
+package processor
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	// Equal jitter: the delay is within [backoff/2, backoff).
+	tests := []struct {
+		attempt int64
+		backoff time.Duration
+	}{
+		{attempt: 0, backoff: 100 * time.Millisecond},
+		{attempt: 1, backoff: 100 * time.Millisecond},
+		{attempt: 2, backoff: 200 * time.Millisecond},
+		{attempt: 4, backoff: 800 * time.Millisecond},
+		{attempt: 5, backoff: time.Second},
+		{attempt: 100, backoff: time.Second},
+		{attempt: math.MaxInt64, backoff: time.Second},
+	}
+
+	for _, tt := range tests {
+		for range 100 {
+			delay := policy.Delay(tt.attempt)
+			if delay < tt.backoff/2 || delay >= tt.backoff {
+				t.Fatalf("Delay(%d) = %v, want within [%v, %v)", tt.attempt, delay, tt.backoff/2, tt.backoff)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyDelayOverflow(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Duration(math.MaxInt64 / 3), MaxDelay: time.Duration(math.MaxInt64)}
+
+	if delay := policy.Delay(10); delay <= 0 {
+		t.Errorf("Delay(10) = %v, want positive", delay)
+	}
+}
+
+func TestRetryPolicyExhausted(t *testing.T) {
+	tests := []struct {
+		maxAttempts int64
+		attempts    int64
+		want        bool
+	}{
+		{maxAttempts: 3, attempts: 1, want: false},
+		{maxAttempts: 3, attempts: 2, want: false},
+		{maxAttempts: 3, attempts: 3, want: true},
+		{maxAttempts: 3, attempts: 4, want: true},
+		{maxAttempts: 0, attempts: 1000, want: false},
+	}
+
+	for _, tt := range tests {
+		policy := RetryPolicy{MaxAttempts: tt.maxAttempts}
+		if got := policy.Exhausted(tt.attempts); got != tt.want {
+			t.Errorf("RetryPolicy{MaxAttempts: %d}.Exhausted(%d) = %v, want %v", tt.maxAttempts, tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package processor
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+type GatewayCandidate struct {
+	Gateway  *PaymentGateway
+	Health   *HealthStatus
+	Observed GatewayMetrics
+	Circuit  CircuitState
+	// Blocked is set when the gateway cannot take a call right now even though
+	// it reports itself healthy, e.g. its circuit breaker is open.
+	Blocked bool
+	// Saturated is set when the gateway used up its rate limit; it is only
+	// chosen when every other gateway is unavailable too.
+	Saturated bool
+}
+
+func (c GatewayCandidate) Available() bool {
+	return !c.Health.Failing && !c.Blocked && !c.Saturated
+}
+
+// Latency is the worst of what the gateway reports and the observed median,
+// since the reported value is only a minimum. The EWMA stands in for the median
+// when no call was made recently.
+func (c GatewayCandidate) Latency() time.Duration {
+	reported := time.Duration(c.Health.MinResponseTime) * time.Millisecond
+	observed := c.Observed.MedianLatency()
+	if observed == 0 {
+		observed = c.Observed.LatencyEWMA
+	}
+
+	return max(reported, observed)
+}
+
+// TailLatency is the observed p99, never below Latency.
+func (c GatewayCandidate) TailLatency() time.Duration {
+	return max(c.Latency(), c.Observed.TailLatency())
+}
+
+// RoutingPolicy picks the gateway for the next payment. Candidates come in
+// registry order (priority, then fee); nil means no gateway should be used.
+type RoutingPolicy interface {
+	Choose(candidates []GatewayCandidate) *PaymentGateway
+}
+
+type RoutingOptions struct {
+	Weights         map[string]int
+	SwitchAbove     time.Duration
+	SwitchBackBelow time.Duration
+}
+
+func NewRoutingPolicy(name string, opts RoutingOptions) (RoutingPolicy, error) {
+	switch name {
+	case "", "sticky":
+		return NewStickyPolicy(opts.SwitchAbove, opts.SwitchBackBelow), nil
+	case "cost":
+		return CostFirstPolicy{}, nil
+	case "latency":
+		return LatencyFirstPolicy{}, nil
+	case "weighted":
+		return WeightedPolicy{Weights: opts.Weights}, nil
+	default:
+		return nil, fmt.Errorf("unknown routing policy %q", name)
+	}
+}
+
+// CostFirstPolicy always uses the available gateway with the lowest fee,
+// falling back to registry order on ties.
+type CostFirstPolicy struct{}
+
+func (CostFirstPolicy) Choose(candidates []GatewayCandidate) *PaymentGateway {
+	var best *PaymentGateway
+	for _, c := range candidates {
+		if c.Available() && (best == nil || c.Gateway.Fee() < best.Fee()) {
+			best = c.Gateway
+		}
+	}
+
+	return best
+}
+
+// LatencyFirstPolicy uses the available gateway with the lowest latency,
+// breaking ties on tail latency and then on registry order.
+type LatencyFirstPolicy struct{}
+
+func (LatencyFirstPolicy) Choose(candidates []GatewayCandidate) *PaymentGateway {
+	var best *GatewayCandidate
+	for i := range candidates {
+		c := &candidates[i]
+		if !c.Available() {
+			continue
+		}
+
+		if best == nil || c.Latency() < best.Latency() ||
+			(c.Latency() == best.Latency() && c.TailLatency() < best.TailLatency()) {
+			best = c
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	return best.Gateway
+}
+
+// WeightedPolicy splits traffic among available gateways proportionally to
+// their weights. Gateways without a weight receive no traffic unless no
+// weighted gateway is available.
+type WeightedPolicy struct {
+	Weights map[string]int
+}
+
+func (p WeightedPolicy) Choose(candidates []GatewayCandidate) *PaymentGateway {
+	total := 0
+	for _, c := range candidates {
+		if c.Available() {
+			total += max(p.Weights[c.Gateway.Name()], 0)
+		}
+	}
+
+	if total == 0 {
+		return CostFirstPolicy{}.Choose(candidates)
+	}
+
+	pick := rand.IntN(total)
+	for _, c := range candidates {
+		if !c.Available() {
+			continue
+		}
+
+		pick -= max(p.Weights[c.Gateway.Name()], 0)
+		if pick < 0 {
+			return c.Gateway
+		}
+	}
+
+	return nil
+}
+
+// StickyPolicy sticks to the first gateway in the registry and only moves away
+// from it when its latency goes above SwitchAbove, moving back once it drops
+// below SwitchBackBelow. The gap between both thresholds keeps routing from
+// flapping when latency hovers around a single value.
+type StickyPolicy struct {
+	switchAbove     time.Duration
+	switchBackBelow time.Duration
+
+	mu       sync.Mutex
+	degraded bool
+}
+
+func NewStickyPolicy(switchAbove, switchBackBelow time.Duration) *StickyPolicy {
+	return &StickyPolicy{
+		switchAbove:     switchAbove,
+		switchBackBelow: min(switchBackBelow, switchAbove),
+	}
+}
+
+func (p *StickyPolicy) Choose(candidates []GatewayCandidate) *PaymentGateway {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	primary := candidates[0]
+	alternative := CostFirstPolicy{}.Choose(candidates[1:])
+
+	if !primary.Available() {
+		return alternative
+	}
+
+	p.mu.Lock()
+	latency := primary.Latency()
+	if p.degraded && latency < p.switchBackBelow {
+		p.degraded = false
+	} else if !p.degraded && latency > p.switchAbove {
+		p.degraded = true
+	}
+	degraded := p.degraded
+	p.mu.Unlock()
+
+	if degraded && alternative != nil {
+		return alternative
+	}
+
+	return primary.Gateway
+}
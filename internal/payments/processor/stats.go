@@ -0,0 +1,202 @@
+package processor
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	statsSmoothing = 0.2
+	// Percentiles cover between one and two windows of calls: the current one
+	// and the previous, complete one.
+	latencyWindow = 10 * time.Second
+)
+
+// Upper bounds of the latency histogram buckets; calls slower than the last
+// bound land in an overflow bucket.
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	300 * time.Millisecond,
+	500 * time.Millisecond,
+	750 * time.Millisecond,
+	time.Second,
+	1500 * time.Millisecond,
+	2 * time.Second,
+	3 * time.Second,
+	5 * time.Second,
+	7500 * time.Millisecond,
+	10 * time.Second,
+	15 * time.Second,
+	30 * time.Second,
+}
+
+// GatewayMetrics is what was observed from real calls to a gateway, as opposed
+// to what the gateway reports about itself. Cluster values aggregate the
+// latency published by every instance and are zero until peers have reported.
+type GatewayMetrics struct {
+	Requests         int64
+	Failures         int64
+	LatencyEWMA      time.Duration
+	ErrorRate        float64
+	P50              time.Duration
+	P99              time.Duration
+	ClusterP50       time.Duration
+	ClusterP99       time.Duration
+	ConcurrencyLimit int
+	InFlight         int
+}
+
+// MedianLatency prefers the cluster-wide view, which reflects more calls than
+// this instance made on its own.
+func (m GatewayMetrics) MedianLatency() time.Duration {
+	if m.ClusterP50 > 0 {
+		return m.ClusterP50
+	}
+	return m.P50
+}
+
+func (m GatewayMetrics) TailLatency() time.Duration {
+	if m.ClusterP99 > 0 {
+		return m.ClusterP99
+	}
+	return m.P99
+}
+
+type latencyHistogram struct {
+	counts [len(latencyBuckets) + 1]int64
+	total  int64
+}
+
+func (h *latencyHistogram) observe(latency time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && latency > latencyBuckets[i] {
+		i++
+	}
+
+	h.counts[i]++
+	h.total++
+}
+
+func (h *latencyHistogram) merge(other *latencyHistogram) {
+	for i, count := range other.counts {
+		h.counts[i] += count
+	}
+	h.total += other.total
+}
+
+// quantile returns the upper bound of the bucket holding the q-th quantile of
+// the merged histograms.
+func quantile(q float64, histograms ...*latencyHistogram) time.Duration {
+	var total int64
+	for _, h := range histograms {
+		total += h.total
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	rank := int64(q*float64(total-1)) + 1
+	var cumulative int64
+	for i := range len(latencyBuckets) + 1 {
+		for _, h := range histograms {
+			cumulative += h.counts[i]
+		}
+
+		if cumulative >= rank {
+			if i == len(latencyBuckets) {
+				return 2 * latencyBuckets[len(latencyBuckets)-1]
+			}
+			return latencyBuckets[i]
+		}
+	}
+
+	return 2 * latencyBuckets[len(latencyBuckets)-1]
+}
+
+type gatewayStats struct {
+	mu          sync.Mutex
+	metrics     GatewayMetrics
+	current     latencyHistogram
+	previous    latencyHistogram
+	windowStart time.Time
+}
+
+func (s *gatewayStats) Observe(latency time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rotate(time.Now())
+	s.current.observe(latency)
+
+	failure := 0.0
+	if failed {
+		failure = 1.0
+		s.metrics.Failures++
+	}
+
+	if s.metrics.Requests == 0 {
+		s.metrics.LatencyEWMA = latency
+		s.metrics.ErrorRate = failure
+	} else {
+		s.metrics.LatencyEWMA += time.Duration(statsSmoothing * float64(latency-s.metrics.LatencyEWMA))
+		s.metrics.ErrorRate += statsSmoothing * (failure - s.metrics.ErrorRate)
+	}
+	s.metrics.Requests++
+}
+
+func (s *gatewayStats) SetClusterLatency(p50, p99 time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics.ClusterP50 = p50
+	s.metrics.ClusterP99 = p99
+}
+
+func (s *gatewayStats) Snapshot() GatewayMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rotate(time.Now())
+
+	metrics := s.metrics
+	metrics.P50 = quantile(0.5, &s.current, &s.previous)
+	metrics.P99 = quantile(0.99, &s.current, &s.previous)
+
+	return metrics
+}
+
+// windowHistogram merges the current and previous windows, which is what the
+// local percentiles are computed from.
+func (s *gatewayStats) windowHistogram() latencyHistogram {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rotate(time.Now())
+
+	merged := s.current
+	merged.merge(&s.previous)
+	return merged
+}
+
+func (s *gatewayStats) rotate(now time.Time) {
+	elapsed := now.Sub(s.windowStart)
+	if elapsed < latencyWindow {
+		return
+	}
+
+	if elapsed < 2*latencyWindow {
+		s.previous = s.current
+	} else {
+		s.previous = latencyHistogram{}
+	}
+	s.current = latencyHistogram{}
+	s.windowStart = now
+}
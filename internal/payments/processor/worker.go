@@ -2,49 +2,127 @@ package processor
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/vrtineu/payments-proxy/internal/logging"
+	"github.com/vrtineu/payments-proxy/internal/metrics"
 	"github.com/vrtineu/payments-proxy/internal/payments"
+	"github.com/vrtineu/payments-proxy/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type PaymentWorker struct {
-	queue           *payments.PaymentsQueue
-	storage         *payments.PaymentsStorage
-	healthChecker   *HealthChecker
-	defaultGateway  *PaymentGateway
-	fallbackGateway *PaymentGateway
-	concurrent      int
+	queue         *payments.PaymentsQueue
+	storage       *payments.PaymentsStorage
+	statuses      *payments.PaymentStatusStore
+	pending       *payments.PendingAttemptStore
+	healthChecker *HealthChecker
+	registry      *GatewayRegistry
+	router        RoutingPolicy
+	retryPolicy   RetryPolicy
+	claimMinIdle  time.Duration
+	maxLimitWait  time.Duration
+	// loops counts the calls to Start; each one reads its share of the free
+	// slots.
+	loops atomic.Int32
+	// aborted is cancelled by Abort to interrupt the gateway calls still in
+	// flight when shutdown runs out of time.
+	aborted context.Context
+	abort   context.CancelFunc
 }
 
-func NewPaymentWorker(queue *payments.PaymentsQueue, storage *payments.PaymentsStorage, healthChecker *HealthChecker, defaultGateway *PaymentGateway, fallbackGateway *PaymentGateway) *PaymentWorker {
+// WorkerOptions configures how messages are retried and recovered.
+type WorkerOptions struct {
+	RetryPolicy RetryPolicy
+	// ClaimMinIdle is how long a message stays with a consumer before another
+	// one may claim it. It must exceed the time one attempt can take, or the
+	// message is processed twice at once.
+	ClaimMinIdle time.Duration
+	// MaxLimitWait bounds the wait for a gateway's limits, keeping attempts
+	// well within ClaimMinIdle; a call that cannot start in time is retried.
+	MaxLimitWait time.Duration
+}
+
+// How long the dequeue loop waits for a free slot when every gateway is at its
+// concurrency limit.
+const capacityPollInterval = 10 * time.Millisecond
+
+var (
+	errNoGatewayAvailable = errors.New("no gateway available")
+	errLimitWaitExceeded  = errors.New("gateway limits not available in time")
+	// The gateway of a pending attempt that may still be in flight is not
+	// accepting calls, and the payment cannot go anywhere else yet.
+	errPendingGatewayBlocked = errors.New("pending gateway not accepting calls")
+)
+
+// messageAttempts counts the attempts made on a message. Every delivery grows
+// the backoff, but only calls that reached a processor count toward the retry
+// limit, and a payment a processor may have charged is never given up on.
+type messageAttempts struct {
+	deliveries int64
+	calls      int64
+	// pending is set while a pending attempt may exist for the payment.
+	pending bool
+}
+
+// A message whose payload cannot be processed no matter how many times it is
+// delivered; it is dead-lettered on the first failure.
+type permanentMessageError struct {
+	err error
+}
+
+func (e *permanentMessageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentMessageError) Unwrap() error {
+	return e.err
+}
+
+func NewPaymentWorker(queue *payments.PaymentsQueue, storage *payments.PaymentsStorage, statuses *payments.PaymentStatusStore, pending *payments.PendingAttemptStore, healthChecker *HealthChecker, registry *GatewayRegistry, router RoutingPolicy, opts WorkerOptions) *PaymentWorker {
+	aborted, abort := context.WithCancel(context.Background())
+
 	return &PaymentWorker{
-		queue:           queue,
-		storage:         storage,
-		healthChecker:   healthChecker,
-		defaultGateway:  defaultGateway,
-		fallbackGateway: fallbackGateway,
-		concurrent:      32,
+		queue:         queue,
+		storage:       storage,
+		statuses:      statuses,
+		pending:       pending,
+		healthChecker: healthChecker,
+		registry:      registry,
+		router:        router,
+		retryPolicy:   opts.RetryPolicy,
+		claimMinIdle:  opts.ClaimMinIdle,
+		maxLimitWait:  opts.MaxLimitWait,
+		aborted:       aborted,
+		abort:         abort,
 	}
 }
 
+// Start reads and processes messages until ctx is cancelled. Messages already
+// read are still processed to completion, so Start returns once the current
+// batch is done; use Abort to cut it short.
 func (pw *PaymentWorker) Start(ctx context.Context) {
+	loop := int(pw.loops.Add(1)) - 1
+
 	var wg sync.WaitGroup
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		pw.runDequeueWorker(ctx)
+		pw.runDequeueWorker(ctx, loop)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		pw.runAutoClaimWorker(ctx)
+		pw.runAutoClaimWorker(ctx, loop)
 	}()
 
 	<-ctx.Done()
@@ -52,14 +130,32 @@ func (pw *PaymentWorker) Start(ctx context.Context) {
 	wg.Wait()
 }
 
-func (pw *PaymentWorker) runDequeueWorker(ctx context.Context) {
+// Abort interrupts the gateway calls in flight. Interrupted payments are
+// handled like ambiguous timeouts and scheduled for retry, which releases
+// their messages for other instances.
+func (pw *PaymentWorker) Abort() {
+	pw.abort()
+}
+
+func (pw *PaymentWorker) runDequeueWorker(ctx context.Context, loop int) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
+			// Messages read while every gateway is at its limit would only
+			// queue on the limiters.
+			capacity := pw.capacity(loop)
+			if capacity == 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(capacityPollInterval):
+				}
+				continue
+			}
+
 			dequeueCtx, cancel := context.WithTimeout(ctx, 1*time.Second)
-			messages, err := pw.queue.Dequeue(dequeueCtx, pw.healthChecker.instanceID, int64(pw.concurrent))
+			messages, err := pw.queue.Dequeue(dequeueCtx, pw.healthChecker.instanceID, int64(capacity))
 			cancel()
 
 			if err != nil {
@@ -73,7 +169,7 @@ func (pw *PaymentWorker) runDequeueWorker(ctx context.Context) {
 	}
 }
 
-func (pw *PaymentWorker) runAutoClaimWorker(ctx context.Context) {
+func (pw *PaymentWorker) runAutoClaimWorker(ctx context.Context, loop int) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
@@ -84,9 +180,9 @@ func (pw *PaymentWorker) runAutoClaimWorker(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			nextStart, err := pw.handleAutoClaimMessages(ctx, start)
+			nextStart, err := pw.handleAutoClaimMessages(ctx, loop, start)
 			if err != nil {
-				log.Printf("Error in auto claim worker: %v\n", err)
+				slog.Error("auto-claiming pending messages", logging.Err(err))
 				start = "0-0"
 				continue
 			}
@@ -95,8 +191,36 @@ func (pw *PaymentWorker) runAutoClaimWorker(ctx context.Context) {
 	}
 }
 
+// RunRetryPromoter moves scheduled retries that are due back into the stream.
+// The promotion is atomic, so running it on every instance is safe.
+func (pw *PaymentWorker) RunRetryPromoter(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := pw.queue.PromoteDueRetries(ctx, time.Now(), int64(pw.concurrency())*4); err != nil {
+				slog.Error("promoting due retries", logging.Err(err))
+			}
+		}
+	}
+}
+
 func (pw *PaymentWorker) handleNormalMessages(ctx context.Context, messages []redis.XMessage) error {
-	sem := make(chan struct{}, pw.concurrent)
+	// Messages read with ">" are on their first delivery.
+	pw.processMessages(ctx, messages, func(string) int64 { return 1 })
+	return nil
+}
+
+func (pw *PaymentWorker) processMessages(ctx context.Context, messages []redis.XMessage, deliveries func(id string) int64) {
+	// Messages already read outlive a stop request: their outcome still has to
+	// be recorded and acknowledged.
+	ctx = context.WithoutCancel(ctx)
+
+	sem := make(chan struct{}, pw.concurrency())
 	var wg sync.WaitGroup
 
 	for _, msg := range messages {
@@ -107,21 +231,25 @@ func (pw *PaymentWorker) handleNormalMessages(ctx context.Context, messages []re
 				<-sem
 				wg.Done()
 			}()
-			pw.processMessage(ctx, message)
+			pw.processMessage(ctx, message, deliveries(message.ID))
 		}(msg)
 	}
 
 	wg.Wait()
-	return nil
 }
 
-func (pw *PaymentWorker) handleAutoClaimMessages(ctx context.Context, start string) (string, error) {
+func (pw *PaymentWorker) handleAutoClaimMessages(ctx context.Context, loop int, start string) (string, error) {
+	capacity := pw.capacity(loop)
+	if capacity == 0 {
+		return start, nil
+	}
+
 	messages, nextStart, err := pw.queue.AutoClaimPending(
 		ctx,
 		pw.healthChecker.instanceID,
-		10*time.Second,
+		pw.claimMinIdle,
 		start,
-		10,
+		int64(capacity),
 	)
 	if err != nil {
 		return "0-0", fmt.Errorf("auto-claim failed: %w", err)
@@ -131,38 +259,256 @@ func (pw *PaymentWorker) handleAutoClaimMessages(ctx context.Context, start stri
 		return "0-0", nil
 	}
 
-	for _, msg := range messages {
-		pw.processMessage(ctx, msg)
+	metrics.AutoClaimRecovered.Add(float64(len(messages)))
+
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
 	}
 
+	deliveries, err := pw.queue.DeliveryCounts(ctx, ids)
+	if err != nil {
+		slog.Error("reading delivery counts", logging.Err(err))
+	}
+
+	pw.processMessages(ctx, messages, func(id string) int64 { return deliveries[id] })
+
 	return nextStart, nil
 }
 
-func (pw *PaymentWorker) processMessage(ctx context.Context, msg redis.XMessage) {
+func (pw *PaymentWorker) processMessage(ctx context.Context, msg redis.XMessage, deliveries int64) {
+	// Attempts made before the payment was parked in the retry set plus the
+	// deliveries of the current stream entry.
+	attempts := messageAttempts{
+		deliveries: parsePriorCount(msg, "attempt") + max(deliveries, 1),
+		calls:      parsePriorCount(msg, "calls"),
+	}
+
+	// The span continues the trace of the request that enqueued the payment.
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, msg.Values), "payments.process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			tracing.MessageIDKey.String(msg.ID),
+			tracing.AttemptKey.Int64(attempts.deliveries),
+		),
+	)
+	defer span.End()
+
 	correlationID, amount, err := pw.parseMessageData(msg)
+	span.SetAttributes(tracing.CorrelationIDKey.String(correlationID))
+	ctx = logging.With(logging.WithTrace(ctx),
+		logging.CorrelationIDKey, correlationID,
+		logging.MessageIDKey, msg.ID,
+	)
 	if err != nil {
+		pw.handleMessageFailure(ctx, msg, correlationID, "", &permanentMessageError{err: err}, attempts)
 		return
 	}
 
-	gateway := pw.getPaymentGateway(ctx)
-	if gateway == nil {
+	// Any delivery may follow an attempt whose outcome was never recorded: an
+	// ambiguous call, a crash mid-call or a retry that failed to be scheduled.
+	pending, err := pw.pending.Get(ctx, correlationID)
+	attempts.pending = err != nil || pending != nil
+	if err != nil {
+		pw.handleMessageFailure(ctx, msg, correlationID, "", fmt.Errorf("reading pending attempt: %w", err), attempts)
+		return
+	}
+	if pending != nil && pending.Charged {
+		ctx = logging.With(ctx, logging.GatewayKey, pending.Gateway.String())
+		pw.completePayment(ctx, msg, pending.Payment(correlationID, amount), "recorded after an earlier storage failure")
+		return
+	}
+	resolution := resolutionNotFound
+	if pending != nil {
+		resolution = pw.resolveAmbiguousAttempt(ctx, msg, correlationID, amount, pending, attempts)
+	}
+
+	var gateway *PaymentGateway
+	var payment *payments.Payment
+	switch resolution {
+	case resolutionResend:
+		// The same request goes to the same gateway, which rejects it as a
+		// duplicate if the earlier call still gets through.
+		gateway = pw.registry.Get(pending.Gateway.String())
+		if !gateway.breaker.Allow() {
+			pw.handleMessageFailure(ctx, msg, correlationID, gateway.Name(), errPendingGatewayBlocked, attempts)
+			return
+		}
+		payment = pending.Payment(correlationID, amount)
+	case resolutionNotFound:
+		gateway = pw.getPaymentGateway(ctx)
+		if gateway == nil {
+			metrics.RoutingDecisions.WithLabelValues("none").Inc()
+			pw.handleMessageFailure(ctx, msg, correlationID, "", errNoGatewayAvailable, attempts)
+			return
+		}
+		metrics.RoutingDecisions.WithLabelValues(gateway.Name()).Inc()
+		payment = payments.NewPayment(correlationID, amount, gateway.gatewayType, gateway.fee)
+	default:
 		return
 	}
 
-	payment := payments.NewPayment(correlationID, amount, gateway.gatewayType)
+	span.SetAttributes(tracing.GatewayKey.String(gateway.Name()))
+	ctx = logging.With(ctx, logging.GatewayKey, gateway.Name())
 
-	if err := gateway.ProcessPayment(ctx, payment); err != nil {
+	// The gateway is remembered before the call, so that no later delivery
+	// sends the payment elsewhere until this gateway's outcome is known.
+	attempts.pending = true
+	if err := pw.pending.Begin(ctx, payment); err != nil {
+		gateway.breaker.Cancel()
+		pw.handleMessageFailure(ctx, msg, correlationID, gateway.gatewayType.String(), fmt.Errorf("recording pending attempt: %w", err), attempts)
 		return
 	}
 
-	if err := pw.storage.SaveToGatewaySets(ctx, payment); err != nil {
+	pw.updateStatus(ctx, correlationID, payments.StatusUpdate{
+		State:      payments.StateInFlight,
+		Gateway:    gateway.gatewayType.String(),
+		MessageID:  msg.ID,
+		NewAttempt: true,
+	})
+
+	reason := ""
+	called, err := pw.callGateway(ctx, gateway, payment)
+	if called {
+		attempts.calls++
+	}
+	if err != nil {
+		// After an ambiguous failure the pending attempt stays, so the next
+		// attempt first asks this gateway whether it charged the payment. Any
+		// other failure certainly did not charge it, and the next attempt may
+		// go anywhere; should the clear fail, it asks this gateway first.
+		kind, _ := ErrorKindOf(err)
+		if kind != ErrorAmbiguous && kind != ErrorDuplicate {
+			if err := pw.pending.Clear(ctx, correlationID); err != nil {
+				logging.FromContext(ctx).Error("clearing pending attempt", logging.Err(err))
+			} else {
+				attempts.pending = false
+			}
+		}
+
+		// A duplicate means an earlier attempt already charged this payment on
+		// this gateway, so it is recorded as processed instead of retried.
+		if kind != ErrorDuplicate {
+			pw.handleMessageFailure(ctx, msg, correlationID, gateway.gatewayType.String(), err, attempts)
+			return
+		}
+
+		// The lookup only confirms the charge; the payment is recorded as the
+		// pending attempt has it, with the fee rate captured when it was sent.
+		logging.FromContext(ctx).Info("payment already processed by the gateway, recording it")
+		if err := gateway.LookupPayment(ctx, correlationID); err != nil {
+			pw.handleMessageFailure(ctx, msg, correlationID, gateway.gatewayType.String(), fmt.Errorf("looking up duplicate payment: %w", err), attempts)
+			return
+		}
+
+		reason = "duplicate acknowledged by processor"
+	}
+
+	if pw.completePayment(ctx, msg, payment, reason) {
+		logging.FromContext(ctx).Info("payment processed", "attempt", attempts.deliveries)
+	}
+}
+
+// completePayment records a payment its processor accepted. The processor call
+// and the recording are two separate steps, so a storage failure must neither
+// dead-letter the payment nor let it reach another gateway: the pending attempt
+// is marked as charged, the message stays pending, and once it is reclaimed
+// only the recording is retried. If even the mark fails, the pending attempt
+// written before the call still makes the next delivery ask this gateway.
+func (pw *PaymentWorker) completePayment(ctx context.Context, msg redis.XMessage, payment *payments.Payment, reason string) bool {
+	logger := logging.FromContext(ctx)
+
+	if err := pw.storage.CompletePayment(ctx, payment, msg.ID); err != nil {
+		logger.Error("completing processed payment", logging.Err(err))
+		if err := pw.pending.MarkCharged(ctx, payment); err != nil {
+			logger.Error("marking pending attempt as charged", logging.Err(err))
+		}
+		return false
+	}
+
+	pw.updateStatus(ctx, payment.CorrelationID, payments.StatusUpdate{
+		State:       payments.StateProcessed,
+		Gateway:     payment.Gateway.String(),
+		MessageID:   msg.ID,
+		Reason:      reason,
+		ProcessedAt: time.Now(),
+	})
+
+	return true
+}
+
+// handleMessageFailure retries the message, or dead-letters it when it can
+// never succeed or its processor calls are exhausted. A payment with a pending
+// attempt may have been charged, so it is retried until that is resolved.
+func (pw *PaymentWorker) handleMessageFailure(ctx context.Context, msg redis.XMessage, correlationID, gateway string, err error, attempts messageAttempts) {
+	tracing.RecordError(trace.SpanFromContext(ctx), err)
+
+	if pw.shouldRetry(err, attempts) {
+		pw.scheduleRetry(ctx, msg, correlationID, gateway, err, attempts)
+		return
+	}
+
+	logger := logging.FromContext(ctx)
+	if dlErr := pw.queue.DeadLetter(ctx, msg, err.Error(), attempts.deliveries, attempts.calls); dlErr != nil {
+		logger.Error("dead-lettering message", logging.Err(dlErr), "cause", err.Error(), "attempt", attempts.deliveries, "calls", attempts.calls)
 		return
 	}
 
-	pw.handleMessageCompletion(ctx, msg.ID)
+	logger.Error("payment dead-lettered", logging.Err(err), "attempt", attempts.deliveries, "calls", attempts.calls)
+
+	if correlationID != "" {
+		pw.updateStatus(ctx, correlationID, payments.StatusUpdate{
+			State:     payments.StateDeadLettered,
+			Gateway:   gateway,
+			MessageID: msg.ID,
+			Reason:    err.Error(),
+		})
+	}
+}
+
+func (pw *PaymentWorker) shouldRetry(err error, attempts messageAttempts) bool {
+	return attempts.pending || (!isPermanentFailure(err) && !pw.retryPolicy.Exhausted(attempts.calls))
+}
+
+func isPermanentFailure(err error) bool {
+	var permanent *permanentMessageError
+	if errors.As(err, &permanent) {
+		return true
+	}
+
+	kind, _ := ErrorKindOf(err)
+	return kind == ErrorPermanent
+}
+
+func (pw *PaymentWorker) scheduleRetry(ctx context.Context, msg redis.XMessage, correlationID, gateway string, err error, attempts messageAttempts) {
+	retryAt := time.Now().Add(pw.retryPolicy.Delay(attempts.deliveries))
+
+	// When scheduling fails the message simply stays pending and is recovered
+	// by the auto-claim worker.
+	logger := logging.FromContext(ctx)
+	if schedErr := pw.queue.ScheduleRetry(ctx, msg, attempts.deliveries, attempts.calls, err.Error(), retryAt); schedErr != nil {
+		logger.Error("scheduling retry", logging.Err(schedErr), "cause", err.Error(), "attempt", attempts.deliveries)
+	} else {
+		logger.Warn("payment attempt failed, retry scheduled", logging.Err(err), "attempt", attempts.deliveries, "retryAt", retryAt)
+	}
+
+	if correlationID != "" {
+		pw.updateStatus(ctx, correlationID, payments.StatusUpdate{
+			State:     payments.StateFailed,
+			Gateway:   gateway,
+			MessageID: msg.ID,
+			Reason:    fmt.Sprintf("%v (retry at %s)", err, retryAt.UTC().Format(time.RFC3339Nano)),
+		})
+	}
 }
 
-func (pw *PaymentWorker) parseMessageData(msg redis.XMessage) (string, float64, error) {
+func (pw *PaymentWorker) updateStatus(ctx context.Context, correlationID string, update payments.StatusUpdate) {
+	if err := pw.statuses.Update(ctx, correlationID, update); err != nil {
+		logging.FromContext(ctx).Error("updating payment status", logging.Err(err), "state", update.State)
+	}
+}
+
+func (pw *PaymentWorker) parseMessageData(msg redis.XMessage) (string, payments.Money, error) {
 	correlationID, ok := msg.Values["correlationId"].(string)
 	if !ok {
 		return "", 0, fmt.Errorf("correlationId not found or invalid type")
@@ -173,7 +519,7 @@ func (pw *PaymentWorker) parseMessageData(msg redis.XMessage) (string, float64,
 		return correlationID, 0, fmt.Errorf("amount not found or invalid type")
 	}
 
-	amount, err := strconv.ParseFloat(amountStr, 64)
+	amount, err := payments.ParseMoney(amountStr)
 	if err != nil {
 		return correlationID, 0, fmt.Errorf("invalid amount format: %w", err)
 	}
@@ -181,35 +527,183 @@ func (pw *PaymentWorker) parseMessageData(msg redis.XMessage) (string, float64,
 	return correlationID, amount, nil
 }
 
-func (pw *PaymentWorker) handleMessageCompletion(ctx context.Context, messageID string) {
-	if err := pw.queue.AckMessage(ctx, messageID); err != nil {
-		log.Printf("Error acknowledging message %s: %v\n", messageID, err)
-		return
+// parsePriorCount reads a counter recorded by ScheduleRetry.
+func parsePriorCount(msg redis.XMessage, field string) int64 {
+	countStr, ok := msg.Values[field].(string)
+	if !ok {
+		return 0
 	}
 
-	if err := pw.queue.DeleteMessage(ctx, messageID); err != nil {
-		log.Printf("Error deleting message %s: %v\n", messageID, err)
+	count, err := strconv.ParseInt(countStr, 10, 64)
+	if err != nil || count < 0 {
+		return 0
 	}
+
+	return count
 }
 
-func (pw *PaymentWorker) getPaymentGateway(ctx context.Context) *PaymentGateway {
-	defaultStatus, _ := pw.healthChecker.GetHealthStatus(ctx, pw.defaultGateway)
-	fallbackStatus, _ := pw.healthChecker.GetHealthStatus(ctx, pw.fallbackGateway)
+// callGateway waits for the gateway's rate and concurrency limits and makes
+// the call; the span events tell the waits apart from the call itself. called
+// reports whether the request was sent to the processor.
+func (pw *PaymentWorker) callGateway(ctx context.Context, gateway *PaymentGateway, payment *payments.Payment) (called bool, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "payments.call_gateway",
+		trace.WithAttributes(tracing.GatewayKey.String(gateway.Name())),
+	)
+	defer func() { tracing.End(span, err) }()
 
-	if !defaultStatus.Failing && !fallbackStatus.Failing {
-		if defaultStatus.MinResponseTime > 2000 {
-			return pw.fallbackGateway
-		}
-		return pw.defaultGateway
+	if err := pw.aborted.Err(); err != nil {
+		gateway.breaker.Cancel()
+		return false, gateway.newError(ErrorRetryable, 0, err)
 	}
 
-	if !defaultStatus.Failing {
-		return pw.defaultGateway
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(pw.aborted, cancel)
+	defer stop()
+
+	// A message waiting on the limits still counts as idle for auto-claim, so
+	// both waits share a bound and the attempt is retried later when it runs
+	// out.
+	waitCtx, cancelWait := context.WithTimeoutCause(ctx, pw.maxLimitWait, errLimitWaitExceeded)
+	defer cancelWait()
+
+	if err := gateway.rateLimiter.Wait(waitCtx); err != nil {
+		gateway.breaker.Cancel()
+		return false, gateway.newError(ErrorRetryable, 0, limitWaitError(waitCtx, err))
 	}
+	span.AddEvent("rate limit acquired")
+
+	if err := gateway.limiter.Acquire(waitCtx); err != nil {
+		gateway.breaker.Cancel()
+		return false, gateway.newError(ErrorRetryable, 0, limitWaitError(waitCtx, err))
+	}
+	span.AddEvent("concurrency slot acquired")
+
+	started := time.Now()
+	err = gateway.ProcessPayment(ctx, payment)
+	latency := time.Since(started)
 
-	if !fallbackStatus.Failing {
-		return pw.fallbackGateway
+	// Rejections of the payment itself say nothing about the gateway's health.
+	kind, _ := ErrorKindOf(err)
+	failed := err != nil && (kind == ErrorRetryable || kind == ErrorAmbiguous)
+
+	outcome := "success"
+	if err != nil {
+		outcome = kind.String()
+	}
+	metrics.GatewayCalls.WithLabelValues(gateway.Name(), outcome).Inc()
+	metrics.GatewayCallDuration.WithLabelValues(gateway.Name()).Observe(latency.Seconds())
+
+	gateway.stats.Observe(latency, failed)
+	gateway.breaker.Record(latency, failed)
+	gateway.limiter.Release(latency, failed)
+
+	if err != nil {
+		logging.FromContext(ctx).Warn("gateway call failed", logging.Err(err), "kind", outcome, "latency", latency)
+	}
+
+	return true, err
+}
+
+// limitWaitError reports a wait cut short by maxLimitWait as such, rather than
+// as a plain deadline. Waits give up early when the deadline cannot be met.
+func limitWaitError(ctx context.Context, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(context.Cause(ctx), errLimitWaitExceeded) {
+		return errLimitWaitExceeded
+	}
+
+	return err
+}
+
+// capacity is how many messages a loop reads at once: its share of the free
+// slots of the gateway with the most, since messages read beyond that wait on
+// its limiter and their claim window runs out meanwhile.
+func (pw *PaymentWorker) capacity(loop int) int {
+	free := 0
+	for _, gateway := range pw.registry.All() {
+		free = max(free, gateway.limiter.Limit()-gateway.limiter.InFlight())
+	}
+
+	return loopShare(free, int(pw.loops.Load()), loop)
+}
+
+// loopShare splits free slots among the loops, giving the remainder to the
+// first ones, so that the loops together never read more than free.
+func loopShare(free, loops, loop int) int {
+	if loops <= 0 {
+		return free
+	}
+
+	share := free / loops
+	if loop < free%loops {
+		share++
+	}
+
+	return share
+}
+
+// concurrency is how many messages are processed at once: as many as the most
+// permissive gateway currently takes, since the limiters bound the calls
+// actually made.
+func (pw *PaymentWorker) concurrency() int {
+	concurrency := 1
+	for _, gateway := range pw.registry.All() {
+		concurrency = max(concurrency, gateway.limiter.Limit())
+	}
+
+	return concurrency
+}
+
+func (pw *PaymentWorker) getPaymentGateway(ctx context.Context) *PaymentGateway {
+	gateways := pw.registry.All()
+	candidates := make([]GatewayCandidate, len(gateways))
+
+	for i, gateway := range gateways {
+		health, _ := pw.healthChecker.GetHealthStatus(ctx, gateway)
+		candidates[i] = GatewayCandidate{
+			Gateway:   gateway,
+			Health:    health,
+			Observed:  gateway.Metrics(),
+			Circuit:   gateway.breaker.State(),
+			Blocked:   !gateway.breaker.CanAttempt(),
+			Saturated: gateway.rateLimiter.Saturated(),
+		}
+	}
+
+	// Another worker may take the last half-open trial between the snapshot and
+	// the reservation, so a rejected choice is blocked and routing runs again.
+	// When only saturated gateways are left, the call waits for their quota.
+	for range len(candidates) + 1 {
+		chosen := pw.router.Choose(candidates)
+		if chosen == nil {
+			if !clearSaturated(candidates) {
+				return nil
+			}
+			continue
+		}
+
+		if chosen.breaker.Allow() {
+			return chosen
+		}
+
+		for i := range candidates {
+			if candidates[i].Gateway == chosen {
+				candidates[i].Blocked = true
+			}
+		}
 	}
 
 	return nil
 }
+
+func clearSaturated(candidates []GatewayCandidate) bool {
+	cleared := false
+	for i := range candidates {
+		if candidates[i].Saturated {
+			candidates[i].Saturated = false
+			cleared = true
+		}
+	}
+
+	return cleared
+}
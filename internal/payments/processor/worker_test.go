@@ -0,0 +1,60 @@
+package processor
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPaymentWorkerShouldRetry(t *testing.T) {
+	pw := &PaymentWorker{retryPolicy: RetryPolicy{MaxAttempts: 3}}
+
+	gatewayErr := func(kind ErrorKind) error {
+		return &GatewayError{Kind: kind, Gateway: "default", Err: errors.New("failed")}
+	}
+	invalidMessage := &permanentMessageError{err: errors.New("amount not found or invalid type")}
+
+	tests := []struct {
+		name     string
+		err      error
+		attempts messageAttempts
+		want     bool
+	}{
+		{name: "retryable call", err: gatewayErr(ErrorRetryable), attempts: messageAttempts{deliveries: 1, calls: 1}, want: true},
+		{name: "calls exhausted", err: gatewayErr(ErrorRetryable), attempts: messageAttempts{deliveries: 3, calls: 3}, want: false},
+		{name: "deliveries without calls", err: errNoGatewayAvailable, attempts: messageAttempts{deliveries: 50, calls: 0}, want: true},
+		{name: "deliveries beyond the limit, calls below it", err: errLimitWaitExceeded, attempts: messageAttempts{deliveries: 50, calls: 2}, want: true},
+		{name: "calls exhausted with pending attempt", err: gatewayErr(ErrorAmbiguous), attempts: messageAttempts{deliveries: 5, calls: 5, pending: true}, want: true},
+		{name: "rejected by the processor", err: gatewayErr(ErrorPermanent), attempts: messageAttempts{deliveries: 1, calls: 1}, want: false},
+		{name: "rejected with pending attempt", err: gatewayErr(ErrorPermanent), attempts: messageAttempts{deliveries: 1, calls: 1, pending: true}, want: true},
+		{name: "invalid message", err: invalidMessage, attempts: messageAttempts{deliveries: 1}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pw.shouldRetry(tt.err, tt.attempts); got != tt.want {
+				t.Errorf("shouldRetry(%v, %+v) = %v, want %v", tt.err, tt.attempts, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoopShare(t *testing.T) {
+	tests := []struct {
+		free, loops int
+		want        []int
+	}{
+		{free: 16, loops: 4, want: []int{4, 4, 4, 4}},
+		{free: 10, loops: 4, want: []int{3, 3, 2, 2}},
+		{free: 3, loops: 8, want: []int{1, 1, 1, 0, 0, 0, 0, 0}},
+		{free: 0, loops: 2, want: []int{0, 0}},
+		{free: 5, loops: 1, want: []int{5}},
+	}
+
+	for _, tt := range tests {
+		for loop, want := range tt.want {
+			if got := loopShare(tt.free, tt.loops, loop); got != want {
+				t.Errorf("loopShare(%d, %d, %d) = %d, want %d", tt.free, tt.loops, loop, got, want)
+			}
+		}
+	}
+}
@@ -2,17 +2,53 @@ package payments
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"log/slog"
+	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/vrtineu/payments-proxy/internal/logging"
+	"github.com/vrtineu/payments-proxy/internal/tracing"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	PaymentsStream = "payments_stream"
-	GroupName      = "payments"
+	PaymentsStream   = "payments_stream"
+	DeadLetterStream = "payments_dead_letter"
+	RetrySet         = "payments_retry"
+	GroupName        = "payments"
 )
 
+// Moves retries whose scheduled time has passed back into the stream. The
+// members are the JSON encoded stream fields of the failed message.
+var promoteDueRetriesScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, member in ipairs(due) do
+	local fields = cjson.decode(member)
+	local args = {}
+	for k, v in pairs(fields) do
+		table.insert(args, k)
+		table.insert(args, tostring(v))
+	end
+	redis.call('XADD', KEYS[2], '*', unpack(args))
+	redis.call('ZREM', KEYS[1], member)
+end
+return #due
+`)
+
+type Enqueuer interface {
+	Enqueue(ctx context.Context, payment Payment) error
+}
+
+// TracedPayment carries the trace context of the request that accepted the
+// payment to the flush that writes it.
+type TracedPayment struct {
+	Payment Payment
+	Trace   propagation.MapCarrier
+}
+
 type PaymentsQueue struct {
 	rdb *redis.Client
 }
@@ -33,18 +69,65 @@ func (q *PaymentsQueue) SetupPaymentsQueue(ctx context.Context) error {
 	return nil
 }
 
+// Enqueue writes the payment to the stream along with the trace context of
+// ctx, which the worker restores to continue the trace.
 func (q *PaymentsQueue) Enqueue(ctx context.Context, payment Payment) error {
-	err := q.rdb.XAdd(ctx, &redis.XAddArgs{
-		Stream: PaymentsStream,
-		Values: map[string]any{
-			"correlationId": payment.CorrelationID,
-			"amount":        payment.Amount,
-		},
-	}).Err()
+	ctx, span := tracing.Tracer().Start(ctx, "payments.enqueue",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(tracing.CorrelationIDKey.String(payment.CorrelationID)),
+	)
+
+	err := q.rdb.XAdd(ctx, paymentXAddArgs(payment, tracing.Carrier(ctx))).Err()
+	tracing.End(span, err)
 
 	return err
 }
 
+// EnqueueBatch pipelines the XADDs of a batch. Each entry keeps the trace
+// context of its own request, and the batch span links to all of them.
+func (q *PaymentsQueue) EnqueueBatch(ctx context.Context, batch []TracedPayment) []error {
+	links := make([]trace.Link, len(batch))
+	for i, traced := range batch {
+		links[i] = tracing.Link(traced.Trace)
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "payments.enqueue_batch",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithLinks(links...),
+	)
+	defer span.End()
+
+	errs := make([]error, len(batch))
+	cmds := make([]*redis.StringCmd, len(batch))
+
+	q.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, traced := range batch {
+			cmds[i] = pipe.XAdd(ctx, paymentXAddArgs(traced.Payment, traced.Trace))
+		}
+		return nil
+	})
+
+	for i, cmd := range cmds {
+		errs[i] = cmd.Err()
+	}
+
+	return errs
+}
+
+func paymentXAddArgs(payment Payment, carrier propagation.MapCarrier) *redis.XAddArgs {
+	values := map[string]any{
+		"correlationId": payment.CorrelationID,
+		"amount":        payment.Amount.String(),
+	}
+	for k, v := range carrier {
+		values[k] = v
+	}
+
+	return &redis.XAddArgs{
+		Stream: PaymentsStream,
+		Values: values,
+	}
+}
+
 func (q *PaymentsQueue) Dequeue(ctx context.Context, instanceID string, count int64) ([]redis.XMessage, error) {
 	result := q.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
 		Group:    GroupName,
@@ -55,7 +138,7 @@ func (q *PaymentsQueue) Dequeue(ctx context.Context, instanceID string, count in
 	})
 
 	if result.Err() != nil {
-		log.Printf("Error reading from stream %s: %v\n", PaymentsStream, result.Err())
+		slog.Error("reading from stream", logging.Err(result.Err()), "stream", PaymentsStream)
 		return nil, result.Err()
 	}
 
@@ -68,14 +151,6 @@ func (q *PaymentsQueue) Dequeue(ctx context.Context, instanceID string, count in
 	return stream.Messages, nil
 }
 
-func (q *PaymentsQueue) AckMessage(ctx context.Context, id string) error {
-	return q.rdb.XAck(ctx, PaymentsStream, GroupName, id).Err()
-}
-
-func (q *PaymentsQueue) DeleteMessage(ctx context.Context, id string) error {
-	return q.rdb.XDel(ctx, PaymentsStream, id).Err()
-}
-
 func (q *PaymentsQueue) AutoClaimPending(ctx context.Context, consumer string, minIdle time.Duration, start string, count int64) ([]redis.XMessage, string, error) {
 	res := q.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
 		Stream:   PaymentsStream,
@@ -91,3 +166,96 @@ func (q *PaymentsQueue) AutoClaimPending(ctx context.Context, consumer string, m
 	messages, nextStart := res.Val()
 	return messages, nextStart, nil
 }
+
+func (q *PaymentsQueue) DeliveryCounts(ctx context.Context, ids []string) (map[string]int64, error) {
+	cmds := make([]*redis.XPendingExtCmd, len(ids))
+
+	_, err := q.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: PaymentsStream,
+				Group:  GroupName,
+				Start:  id,
+				End:    id,
+				Count:  1,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(ids))
+	for _, cmd := range cmds {
+		for _, pending := range cmd.Val() {
+			counts[pending.ID] = pending.RetryCount
+		}
+	}
+
+	return counts, nil
+}
+
+func (q *PaymentsQueue) DeadLetter(ctx context.Context, msg redis.XMessage, reason string, attempts, calls int64) error {
+	values := make(map[string]any, len(msg.Values)+5)
+	for k, v := range msg.Values {
+		values[k] = v
+	}
+	values["originalId"] = msg.ID
+	values["error"] = reason
+	values["attempts"] = attempts
+	values["calls"] = calls
+	values["deadLetteredAt"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	_, err := q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: DeadLetterStream,
+			Values: values,
+		})
+		pipe.XAck(ctx, PaymentsStream, GroupName, msg.ID)
+		pipe.XDel(ctx, PaymentsStream, msg.ID)
+		return nil
+	})
+
+	return err
+}
+
+// ScheduleRetry removes the message from the stream and parks it in the retry
+// set until at, recording how many attempts were already made and how many of
+// them reached a processor.
+func (q *PaymentsQueue) ScheduleRetry(ctx context.Context, msg redis.XMessage, attempts, calls int64, reason string, at time.Time) error {
+	values := make(map[string]any, len(msg.Values)+3)
+	for k, v := range msg.Values {
+		values[k] = v
+	}
+	values["attempt"] = strconv.FormatInt(attempts, 10)
+	values["calls"] = strconv.FormatInt(calls, 10)
+	values["lastError"] = reason
+
+	member, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, RetrySet, redis.Z{
+			Score:  float64(at.UnixMilli()),
+			Member: member,
+		})
+		pipe.XAck(ctx, PaymentsStream, GroupName, msg.ID)
+		pipe.XDel(ctx, PaymentsStream, msg.ID)
+		return nil
+	})
+
+	return err
+}
+
+func (q *PaymentsQueue) PromoteDueRetries(ctx context.Context, now time.Time, limit int64) (int64, error) {
+	return promoteDueRetriesScript.Run(
+		ctx,
+		q.rdb,
+		[]string{RetrySet, PaymentsStream},
+		now.UnixMilli(),
+		limit,
+	).Int64()
+}
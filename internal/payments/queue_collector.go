@@ -0,0 +1,73 @@
+package payments
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"github.com/vrtineu/payments-proxy/internal/logging"
+	"github.com/vrtineu/payments-proxy/internal/metrics"
+)
+
+const queueCollectTimeout = time.Second
+
+// QueueCollector reports the size of the stream, its consumer group backlog,
+// the scheduled retries and the dead letters, read from Redis on each scrape.
+type QueueCollector struct {
+	rdb *redis.Client
+
+	streamLength *prometheus.Desc
+	pending      *prometheus.Desc
+	retries      *prometheus.Desc
+	deadLetters  *prometheus.Desc
+}
+
+func NewQueueCollector(queue *PaymentsQueue) *QueueCollector {
+	return &QueueCollector{
+		rdb:          queue.rdb,
+		streamLength: prometheus.NewDesc(metrics.Namespace+"_stream_length", "Entries in the payments stream.", nil, nil),
+		pending:      prometheus.NewDesc(metrics.Namespace+"_stream_pending", "Entries delivered to a consumer and not acknowledged yet.", nil, nil),
+		retries:      prometheus.NewDesc(metrics.Namespace+"_retries_scheduled", "Payments waiting in the retry set.", nil, nil),
+		deadLetters:  prometheus.NewDesc(metrics.Namespace+"_dead_letters", "Entries in the dead-letter stream.", nil, nil),
+	}
+}
+
+func (c *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.streamLength
+	ch <- c.pending
+	ch <- c.retries
+	ch <- c.deadLetters
+}
+
+func (c *QueueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), queueCollectTimeout)
+	defer cancel()
+
+	var streamLength, deadLetters, retries *redis.IntCmd
+	var pending *redis.XPendingCmd
+	_, err := c.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		streamLength = pipe.XLen(ctx, PaymentsStream)
+		pending = pipe.XPending(ctx, PaymentsStream, GroupName)
+		retries = pipe.ZCard(ctx, RetrySet)
+		deadLetters = pipe.XLen(ctx, DeadLetterStream)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		slog.Error("collecting queue metrics", logging.Err(err))
+	}
+
+	if err := streamLength.Err(); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.streamLength, prometheus.GaugeValue, float64(streamLength.Val()))
+	}
+	if err := pending.Err(); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.pending, prometheus.GaugeValue, float64(pending.Val().Count))
+	}
+	if err := retries.Err(); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.retries, prometheus.GaugeValue, float64(retries.Val()))
+	}
+	if err := deadLetters.Err(); err == nil || err == redis.Nil {
+		ch <- prometheus.MustNewConstMetric(c.deadLetters, prometheus.GaugeValue, float64(deadLetters.Val()))
+	}
+}
@@ -0,0 +1,160 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type PaymentState string
+
+const (
+	StateReceived     PaymentState = "received"
+	StateQueued       PaymentState = "queued"
+	StateInFlight     PaymentState = "in_flight"
+	StateFailed       PaymentState = "failed"
+	StateProcessed    PaymentState = "processed"
+	StateDeadLettered PaymentState = "dead_lettered"
+)
+
+// Updates are applied only when they do not move a payment backwards, so a
+// late "queued" written by the ingestion goroutine cannot hide a payment the
+// worker already processed. In-flight and failed share a rank because a failed
+// attempt is retried.
+var stateRanks = map[PaymentState]int{
+	StateReceived:     0,
+	StateQueued:       1,
+	StateInFlight:     2,
+	StateFailed:       2,
+	StateProcessed:    3,
+	StateDeadLettered: 3,
+}
+
+var updatePaymentStatusScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'rank')
+if current and tonumber(current) > tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'rank', ARGV[1], unpack(ARGV, 4))
+if ARGV[3] == '1' then
+	redis.call('HINCRBY', KEYS[1], 'attempts', 1)
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+type PaymentStatus struct {
+	CorrelationID string       `json:"correlationId"`
+	State         PaymentState `json:"state"`
+	Amount        Money        `json:"amount"`
+	Gateway       string       `json:"gateway,omitempty"`
+	MessageID     string       `json:"messageId,omitempty"`
+	Reason        string       `json:"reason,omitempty"`
+	Attempts      int64        `json:"attempts"`
+	ReceivedAt    *time.Time   `json:"receivedAt,omitempty"`
+	ProcessedAt   *time.Time   `json:"processedAt,omitempty"`
+	UpdatedAt     time.Time    `json:"updatedAt"`
+}
+
+type StatusUpdate struct {
+	State       PaymentState
+	Amount      *Money
+	Gateway     string
+	MessageID   string
+	Reason      string
+	NewAttempt  bool
+	ProcessedAt time.Time
+}
+
+type PaymentStatusStore struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+func NewPaymentStatusStore(rdb *redis.Client, ttl time.Duration) *PaymentStatusStore {
+	return &PaymentStatusStore{
+		rdb: rdb,
+		ttl: ttl,
+	}
+}
+
+func (s *PaymentStatusStore) Update(ctx context.Context, correlationID string, update StatusUpdate) error {
+	now := time.Now().UTC()
+
+	fields := []any{"state", string(update.State), "updatedAt", now.Format(time.RFC3339Nano)}
+	if update.State == StateReceived {
+		fields = append(fields, "receivedAt", now.Format(time.RFC3339Nano))
+	}
+	if update.Amount != nil {
+		fields = append(fields, "amount", update.Amount.String())
+	}
+	if update.Gateway != "" {
+		fields = append(fields, "gateway", update.Gateway)
+	}
+	if update.MessageID != "" {
+		fields = append(fields, "messageId", update.MessageID)
+	}
+	if update.Reason != "" || update.State == StateProcessed {
+		fields = append(fields, "reason", update.Reason)
+	}
+	if !update.ProcessedAt.IsZero() {
+		fields = append(fields, "processedAt", update.ProcessedAt.UTC().Format(time.RFC3339Nano))
+	}
+
+	newAttempt := "0"
+	if update.NewAttempt {
+		newAttempt = "1"
+	}
+
+	args := append([]any{stateRanks[update.State], s.ttl.Milliseconds(), newAttempt}, fields...)
+
+	return updatePaymentStatusScript.Run(ctx, s.rdb, []string{paymentStatusKey(correlationID)}, args...).Err()
+}
+
+func (s *PaymentStatusStore) Get(ctx context.Context, correlationID string) (*PaymentStatus, error) {
+	values, err := s.rdb.HGetAll(ctx, paymentStatusKey(correlationID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	status := &PaymentStatus{
+		CorrelationID: correlationID,
+		State:         PaymentState(values["state"]),
+		Gateway:       values["gateway"],
+		MessageID:     values["messageId"],
+		Reason:        values["reason"],
+	}
+
+	if amount, err := ParseMoney(values["amount"]); err == nil {
+		status.Amount = amount
+	}
+	if attempts, err := strconv.ParseInt(values["attempts"], 10, 64); err == nil {
+		status.Attempts = attempts
+	}
+	if updatedAt, err := time.Parse(time.RFC3339Nano, values["updatedAt"]); err == nil {
+		status.UpdatedAt = updatedAt
+	}
+	if receivedAt, err := time.Parse(time.RFC3339Nano, values["receivedAt"]); err == nil {
+		status.ReceivedAt = &receivedAt
+	}
+	if processedAt, err := time.Parse(time.RFC3339Nano, values["processedAt"]); err == nil {
+		status.ProcessedAt = &processedAt
+	}
+
+	return status, nil
+}
+
+func (s *PaymentStatusStore) Delete(ctx context.Context, correlationID string) error {
+	return s.rdb.Del(ctx, paymentStatusKey(correlationID)).Err()
+}
+
+func paymentStatusKey(correlationID string) string {
+	return fmt.Sprintf("payment:status:%s", correlationID)
+}
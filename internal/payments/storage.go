@@ -8,6 +8,47 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+// Records a processed payment in its gateway's ledger and summary buckets and
+// acknowledges and deletes its stream entry in one step, so that no crash can
+// leave a charged payment unrecorded, or recorded but still pending for
+// another attempt. The buckets only count a payment the first time its ledger
+// entry is added, and only from the second after the first payment they saw,
+// so ledger entries written before them are still summed by scanning. The
+// payment's pending attempt is cleared with it.
+//
+// KEYS: ledger, stream, since, pending attempt, then one hash per summary
+// bucket.
+// ARGV: score, member, group, message id, second, amount and fee in cents,
+// then the start of the payment's bucket of each granularity followed by the
+// Unix second its hash expires at, 0 for never.
+var completePaymentScript = redis.NewScript(`
+local added = redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+if added == 1 then
+	local second = tonumber(ARGV[5])
+	local since = tonumber(redis.call('GET', KEYS[3]))
+	if not since then
+		since = second + 1
+		redis.call('SET', KEYS[3], since)
+	end
+	if second >= since then
+		for i = 5, #KEYS do
+			local arg = 2 * i - 2
+			local bucket = ARGV[arg]
+			redis.call('HINCRBY', KEYS[i], bucket .. ':count', 1)
+			redis.call('HINCRBY', KEYS[i], bucket .. ':amount', ARGV[6])
+			redis.call('HINCRBY', KEYS[i], bucket .. ':fee', ARGV[7])
+			if ARGV[arg + 1] ~= '0' then
+				redis.call('EXPIREAT', KEYS[i], ARGV[arg + 1])
+			end
+		end
+	end
+end
+redis.call('XACK', KEYS[2], ARGV[3], ARGV[4])
+redis.call('XDEL', KEYS[2], ARGV[4])
+redis.call('DEL', KEYS[4])
+return added
+`)
+
 type PaymentsStorage struct {
 	rdb *redis.Client
 }
@@ -18,25 +59,53 @@ func NewPaymentsStorage(rdb *redis.Client) *PaymentsStorage {
 	}
 }
 
-func (ps *PaymentsStorage) SaveToGatewaySets(ctx context.Context, payment *Payment) error {
+// LoadScripts loads the completion script with SCRIPT LOAD so that every
+// completion only sends its hash. Redis losing its script cache later is
+// handled by falling back to EVAL once.
+func (ps *PaymentsStorage) LoadScripts(ctx context.Context) error {
+	return completePaymentScript.Load(ctx, ps.rdb).Err()
+}
+
+// CompletePayment records a payment accepted by its processor and removes the
+// stream entry it came from, atomically. Completing the same payment again is
+// harmless: the ledger entry is not duplicated.
+func (ps *PaymentsStorage) CompletePayment(ctx context.Context, payment *Payment, messageID string) error {
 	timestamp, err := time.Parse(time.RFC3339, payment.RequestedAt)
 	if err != nil {
 		return err
 	}
 
-	value := fmt.Sprintf("%s:%f", payment.CorrelationID, payment.Amount)
-	key := fmt.Sprintf("payments:%s", payment.Gateway.String())
+	second := timestamp.Unix()
+	keys := []string{
+		gatewayLedgerKey(payment.Gateway),
+		PaymentsStream,
+		summarySinceKey(payment.Gateway),
+		pendingAttemptKey(payment.CorrelationID),
+	}
+	args := []any{
+		timestamp.UnixNano(),
+		ledgerMember(payment),
+		GroupName,
+		messageID,
+		second,
+		payment.Amount.Cents(),
+		payment.Amount.ApplyRate(payment.FeeRate).Cents(),
+	}
+	for _, bucket := range summaryBuckets {
+		start := second - second%bucket.width
+		keys = append(keys, summaryBucketKey(payment.Gateway, bucket, start))
+		args = append(args, start, bucket.expireAt(start))
+	}
+
+	return completePaymentScript.Run(ctx, ps.rdb, keys, args...).Err()
+}
 
-	return ps.rdb.ZAdd(ctx, key, redis.Z{
-		Score:  float64(timestamp.UnixNano()),
-		Member: value,
-	}).Err()
+// ledgerMember captures the fee rate with the payment so summaries stay
+// correct after the gateway fee configuration changes.
+func ledgerMember(payment *Payment) string {
+	return fmt.Sprintf("%s:%s:%s", payment.CorrelationID, payment.Amount, payment.FeeRate)
 }
 
-func (ps *PaymentsStorage) GetPaymentsByScoreRange(ctx context.Context, gateway GatewayType, fromScore, toScore float64) ([]string, error) {
-	key := fmt.Sprintf("payments:%s", gateway.String())
-	return ps.rdb.ZRangeByScore(ctx, key, &redis.ZRangeBy{
-		Min: fmt.Sprintf("%f", fromScore),
-		Max: fmt.Sprintf("%f", toScore),
-	}).Result()
+func gatewayLedgerKey(gateway GatewayType) string {
+	return fmt.Sprintf("payments:%s", gateway.String())
 }
@@ -0,0 +1,377 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vrtineu/payments-proxy/internal/logging"
+)
+
+// summaryBucket is a granularity of the counters kept per gateway at
+// completion time. Buckets are aligned to the Unix epoch.
+//
+// Fine granularities would grow a single hash without bound, so their buckets
+// are split into hashes of shard seconds that expire retention after the
+// shard ends. Ranges whose shards have expired are scanned from the ledger.
+type summaryBucket struct {
+	name      string
+	width     int64
+	shard     int64
+	retention int64
+}
+
+// Ordered from the finest to the coarsest, matching the keys and arguments of
+// completePaymentScript.
+var summaryBuckets = []summaryBucket{
+	{name: "1s", width: 1, shard: 60 * 60, retention: 24 * 60 * 60},
+	{name: "1m", width: 60, shard: 24 * 60 * 60, retention: 7 * 24 * 60 * 60},
+	{name: "1h", width: 60 * 60},
+	{name: "1d", width: 24 * 60 * 60},
+}
+
+// Shards this close to expiring are no longer read, so that none expires
+// between the decision to read it and the read.
+const summaryShardMargin = 60
+
+// shardStart is the start of the shard holding the bucket starting at start.
+func (b summaryBucket) shardStart(start int64) int64 {
+	if b.shard == 0 {
+		return 0
+	}
+
+	return start - start%b.shard
+}
+
+// expireAt is the Unix second at which the shard holding the bucket starting
+// at start expires, or 0 when the granularity is not sharded.
+func (b summaryBucket) expireAt(start int64) int64 {
+	if b.shard == 0 {
+		return 0
+	}
+
+	return b.shardStart(start) + b.shard + b.retention
+}
+
+// availableFrom is the first bucket start whose shard can still be read at
+// now.
+func (b summaryBucket) availableFrom(now int64) int64 {
+	if b.shard == 0 {
+		return math.MinInt64
+	}
+
+	oldest := now + summaryShardMargin - b.retention - b.shard
+	from := b.shardStart(oldest)
+	if from < oldest {
+		from += b.shard
+	}
+
+	return from
+}
+
+type GatewaySummary struct {
+	TotalRequests int64 `json:"totalRequests"`
+	TotalAmount   Money `json:"totalAmount"`
+	TotalFee      Money `json:"totalFee"`
+	NetAmount     Money `json:"netAmount"`
+}
+
+// nanoRange is the half-open range of ledger scores [from, to).
+type nanoRange struct {
+	from, to int64
+}
+
+// Summary totals the payments of the gateway requested within [from, to]; a
+// zero from or to leaves that end open. Whole buckets inside the range are
+// read from the counters; only the parts of the range that do not cover a
+// whole second, and the ledger entries older than the counters, are scanned.
+func (ps *PaymentsStorage) Summary(ctx context.Context, gateway GatewayInfo, from, to time.Time) (GatewaySummary, error) {
+	var summary GatewaySummary
+
+	lo, hi := summaryRange(from, to)
+	if hi <= lo {
+		return summary, nil
+	}
+
+	var sinceCmd *redis.StringCmd
+	var lastCmd *redis.ZSliceCmd
+	_, err := ps.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		sinceCmd = pipe.Get(ctx, summarySinceKey(gateway.Name))
+		lastCmd = pipe.ZRangeWithScores(ctx, gatewayLedgerKey(gateway.Name), -1, -1)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return summary, err
+	}
+
+	// Nothing was requested after the last ledger entry, which keeps the
+	// number of buckets bounded for open-ended ranges.
+	last := lastCmd.Val()
+	if len(last) == 0 {
+		return summary, nil
+	}
+	hi = min(hi, int64(last[0].Score)+1)
+	if hi <= lo {
+		return summary, nil
+	}
+
+	var scans []nanoRange
+	var buckets [][]int64
+
+	since, err := sinceCmd.Int64()
+	switch {
+	case err == redis.Nil:
+		scans = append(scans, nanoRange{lo, hi})
+	case err != nil:
+		return summary, err
+	default:
+		scans, buckets = splitSummaryRange(lo, hi, since, time.Now().Unix())
+	}
+
+	scanCmds := make([]*redis.StringSliceCmd, len(scans))
+	var bucketCmds []*redis.SliceCmd
+	_, err = ps.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, scan := range scans {
+			scanCmds[i] = pipe.ZRangeByScore(ctx, gatewayLedgerKey(gateway.Name), &redis.ZRangeBy{
+				Min: strconv.FormatInt(scan.from, 10),
+				Max: "(" + strconv.FormatInt(scan.to, 10),
+			})
+		}
+		for i, starts := range buckets {
+			bucket := summaryBuckets[i]
+			for len(starts) > 0 {
+				// Starts are ascending, so each shard's are contiguous.
+				n := 1
+				for n < len(starts) && bucket.shardStart(starts[n]) == bucket.shardStart(starts[0]) {
+					n++
+				}
+				key := summaryBucketKey(gateway.Name, bucket, starts[0])
+				bucketCmds = append(bucketCmds, pipe.HMGet(ctx, key, summaryBucketFields(starts[:n])...))
+				starts = starts[n:]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return summary, err
+	}
+
+	for _, cmd := range scanCmds {
+		summary.addEntries(ctx, cmd.Val(), gateway.Fee)
+	}
+
+	for _, cmd := range bucketCmds {
+		if err := summary.addBuckets(cmd.Val()); err != nil {
+			return summary, err
+		}
+	}
+
+	summary.NetAmount = summary.TotalAmount - summary.TotalFee
+
+	return summary, nil
+}
+
+var (
+	minNanoTime = time.Unix(0, math.MinInt64)
+	maxNanoTime = time.Unix(0, math.MaxInt64)
+)
+
+// summaryRange converts [from, to] to the nanoseconds [lo, hi). A zero time
+// leaves its end open, and times int64 nanoseconds cannot hold are clamped.
+func summaryRange(from, to time.Time) (int64, int64) {
+	lo, hi := int64(math.MinInt64), int64(math.MaxInt64)
+	if !from.IsZero() {
+		lo = clampedUnixNano(from)
+	}
+	if !to.IsZero() {
+		hi = min(clampedUnixNano(to), math.MaxInt64-1) + 1
+	}
+
+	return lo, hi
+}
+
+func clampedUnixNano(t time.Time) int64 {
+	switch {
+	case t.Before(minNanoTime):
+		return math.MinInt64
+	case t.After(maxNanoTime):
+		return math.MaxInt64
+	}
+
+	return t.UnixNano()
+}
+
+// splitSummaryRange divides [lo, hi) into the ranges that must be scanned and
+// the starts of the whole buckets covering the rest, per granularity. Seconds
+// before since are only in the ledger, as are seconds whose buckets have all
+// expired at now.
+func splitSummaryRange(lo, hi, since, now int64) ([]nanoRange, [][]int64) {
+	var scans []nanoRange
+
+	if boundary := since * int64(time.Second); lo < boundary {
+		scans = append(scans, nanoRange{lo, min(hi, boundary)})
+		lo = boundary
+	}
+	if lo >= hi {
+		return scans, nil
+	}
+
+	first := (lo + int64(time.Second) - 1) / int64(time.Second)
+	end := hi / int64(time.Second)
+	if first >= end {
+		return append(scans, nanoRange{lo, hi}), nil
+	}
+
+	if head := first * int64(time.Second); lo < head {
+		scans = append(scans, nanoRange{lo, head})
+	}
+
+	buckets, uncovered := coverSeconds(first, end, now)
+	scans = append(scans, uncovered...)
+
+	if tail := end * int64(time.Second); tail < hi {
+		scans = append(scans, nanoRange{tail, hi})
+	}
+
+	return scans, buckets
+}
+
+// coverSeconds covers the seconds [first, end) with the fewest buckets that
+// can still be read at now, taking at each step the widest bucket that starts
+// there and fits. Seconds no bucket covers are returned as ranges to scan.
+func coverSeconds(first, end, now int64) ([][]int64, []nanoRange) {
+	buckets := make([][]int64, len(summaryBuckets))
+	availableFrom := make([]int64, len(summaryBuckets))
+	for i, bucket := range summaryBuckets {
+		availableFrom[i] = bucket.availableFrom(now)
+	}
+
+	var scans []nanoRange
+	for at := first; at < end; {
+		covered := false
+		for i := len(summaryBuckets) - 1; i >= 0; i-- {
+			width := summaryBuckets[i].width
+			if at%width == 0 && at+width <= end && at >= availableFrom[i] {
+				buckets[i] = append(buckets[i], at)
+				at += width
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+
+		from, to := at*int64(time.Second), (at+1)*int64(time.Second)
+		if n := len(scans); n > 0 && scans[n-1].to == from {
+			scans[n-1].to = to
+		} else {
+			scans = append(scans, nanoRange{from, to})
+		}
+		at++
+	}
+
+	return buckets, scans
+}
+
+func summaryBucketFields(starts []int64) []string {
+	fields := make([]string, 0, len(starts)*3)
+	for _, start := range starts {
+		prefix := strconv.FormatInt(start, 10)
+		fields = append(fields, prefix+":count", prefix+":amount", prefix+":fee")
+	}
+
+	return fields
+}
+
+// addBuckets adds the count, amount and fee triples read by HMGET; buckets
+// without payments have no fields.
+func (s *GatewaySummary) addBuckets(values []any) error {
+	for i := 0; i+2 < len(values); i += 3 {
+		var counters [3]int64
+		for j := range counters {
+			value, ok := values[i+j].(string)
+			if !ok {
+				continue
+			}
+
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid summary counter %q: %w", value, err)
+			}
+			counters[j] = n
+		}
+
+		if err := s.add(counters[0], MoneyFromCents(counters[1]), MoneyFromCents(counters[2])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addEntries totals "correlationId:amount:feeRate" ledger entries. Entries
+// recorded before fee rates were captured have no rate and use legacyFee, the
+// gateway's currently configured fee.
+func (s *GatewaySummary) addEntries(ctx context.Context, data []string, legacyFee FeeRate) {
+	logger := logging.FromContext(ctx)
+
+	for _, entry := range data {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 2 && len(parts) != 3 {
+			continue
+		}
+
+		amount, err := ParseMoney(parts[1])
+		if err != nil {
+			logger.Error("parsing amount of summary entry", logging.Err(err), "entry", entry)
+			continue
+		}
+
+		feeRate := legacyFee
+		if len(parts) == 3 {
+			if feeRate, err = ParseFeeRate(parts[2]); err != nil {
+				logger.Error("parsing fee rate of summary entry", logging.Err(err), "entry", entry)
+				continue
+			}
+		}
+
+		if err := s.add(1, amount, amount.ApplyRate(feeRate)); err != nil {
+			logger.Error("summing summary entry, amount out of range", "entry", entry)
+		}
+	}
+}
+
+func (s *GatewaySummary) add(count int64, amount, fee Money) error {
+	totalAmount, amountErr := s.TotalAmount.Add(amount)
+	totalFee, feeErr := s.TotalFee.Add(fee)
+	if amountErr != nil || feeErr != nil {
+		return ErrMoneyOverflow
+	}
+
+	s.TotalRequests += count
+	s.TotalAmount = totalAmount
+	s.TotalFee = totalFee
+
+	return nil
+}
+
+// summarySinceKey holds the first second counted by the buckets; payments
+// requested before it are only in the ledger.
+func summarySinceKey(gateway GatewayType) string {
+	return fmt.Sprintf("payments:%s:summary:since", gateway.String())
+}
+
+// summaryBucketKey is the hash holding the bucket starting at start; sharded
+// granularities have one hash per shard.
+func summaryBucketKey(gateway GatewayType, bucket summaryBucket, start int64) string {
+	if bucket.shard == 0 {
+		return fmt.Sprintf("payments:%s:summary:%s", gateway.String(), bucket.name)
+	}
+
+	return fmt.Sprintf("payments:%s:summary:%s:%d", gateway.String(), bucket.name, bucket.shardStart(start))
+}
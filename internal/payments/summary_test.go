@@ -0,0 +1,230 @@
+package payments
+
+import (
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// day is aligned to every bucket width and shard.
+const day int64 = 1_699_920_000
+
+const second = int64(time.Second)
+
+func seconds(from, to int64) nanoRange {
+	return nanoRange{from * second, to * second}
+}
+
+// byBucket lists bucket starts in the order of summaryBuckets: 1s, 1m, 1h, 1d.
+func byBucket(s, m, h, d []int64) [][]int64 {
+	return [][]int64{s, m, h, d}
+}
+
+func TestSummaryRange(t *testing.T) {
+	from := time.Unix(day, 0)
+	to := time.Unix(day+60, 0)
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		lo, hi   int64
+	}{
+		{name: "both bounds", from: from, to: to, lo: day * second, hi: (day+60)*second + 1},
+		{name: "missing to", from: from, lo: day * second, hi: math.MaxInt64},
+		{name: "missing from", to: to, lo: math.MinInt64, hi: (day+60)*second + 1},
+		{name: "missing both", lo: math.MinInt64, hi: math.MaxInt64},
+		{name: "beyond int64 nanoseconds", from: time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC), to: time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC), lo: math.MinInt64, hi: math.MaxInt64},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lo, hi := summaryRange(tt.from, tt.to)
+			if lo != tt.lo || hi != tt.hi {
+				t.Errorf("summaryRange() = [%d, %d), want [%d, %d)", lo, hi, tt.lo, tt.hi)
+			}
+		})
+	}
+}
+
+func TestCoverSeconds(t *testing.T) {
+	fresh := day + 24*60*60
+	secondsExpired := day + 2*24*60*60
+	minutesExpired := day + 9*24*60*60
+
+	tests := []struct {
+		name        string
+		first, end  int64
+		now         int64
+		wantBuckets [][]int64
+		wantScans   []nanoRange
+	}{
+		{
+			name:  "seconds",
+			first: day + 1, end: day + 3, now: fresh,
+			wantBuckets: byBucket([]int64{day + 1, day + 2}, nil, nil, nil),
+		},
+		{
+			name:  "whole minute",
+			first: day, end: day + 60, now: fresh,
+			wantBuckets: byBucket(nil, []int64{day}, nil, nil),
+		},
+		{
+			name:  "minute between seconds",
+			first: day + 59, end: day + 121, now: fresh,
+			wantBuckets: byBucket([]int64{day + 59, day + 120}, []int64{day + 60}, nil, nil),
+		},
+		{
+			name:  "whole day",
+			first: day, end: day + 24*60*60, now: fresh,
+			wantBuckets: byBucket(nil, nil, nil, []int64{day}),
+		},
+		{
+			name:  "hour, minute and second",
+			first: day, end: day + 60*60 + 61, now: fresh,
+			wantBuckets: byBucket([]int64{day + 3660}, []int64{day + 3600}, []int64{day}, nil),
+		},
+		{
+			name:  "expired seconds are scanned as one range",
+			first: day + 30, end: day + 90, now: secondsExpired,
+			wantBuckets: byBucket(nil, nil, nil, nil),
+			wantScans:   []nanoRange{seconds(day+30, day+90)},
+		},
+		{
+			name:  "expired seconds around a minute",
+			first: day + 30, end: day + 150, now: secondsExpired,
+			wantBuckets: byBucket(nil, []int64{day + 60}, nil, nil),
+			wantScans:   []nanoRange{seconds(day+30, day+60), seconds(day+120, day+150)},
+		},
+		{
+			name:  "expired minutes around an hour",
+			first: day + 30, end: day + 2*60*60 + 30, now: minutesExpired,
+			wantBuckets: byBucket(nil, nil, []int64{day + 3600}, nil),
+			wantScans:   []nanoRange{seconds(day+30, day+3600), seconds(day+7200, day+7230)},
+		},
+		{
+			name:  "empty",
+			first: day, end: day, now: fresh,
+			wantBuckets: byBucket(nil, nil, nil, nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buckets, scans := coverSeconds(tt.first, tt.end, tt.now)
+			if !reflect.DeepEqual(buckets, tt.wantBuckets) {
+				t.Errorf("buckets = %v, want %v", buckets, tt.wantBuckets)
+			}
+			if !reflect.DeepEqual(scans, tt.wantScans) {
+				t.Errorf("scans = %v, want %v", scans, tt.wantScans)
+			}
+		})
+	}
+}
+
+func TestSplitSummaryRange(t *testing.T) {
+	now := day + 24*60*60
+
+	tests := []struct {
+		name        string
+		lo, hi      int64
+		since       int64
+		wantScans   []nanoRange
+		wantBuckets [][]int64
+	}{
+		{
+			name: "before since",
+			lo:   day * second, hi: (day + 20) * second, since: day + 10,
+			wantScans:   []nanoRange{seconds(day, day+10)},
+			wantBuckets: byBucket([]int64{day + 10, day + 11, day + 12, day + 13, day + 14, day + 15, day + 16, day + 17, day + 18, day + 19}, nil, nil, nil),
+		},
+		{
+			name: "open start",
+			lo:   math.MinInt64, hi: (day + 12) * second, since: day + 10,
+			wantScans:   []nanoRange{{math.MinInt64, (day + 10) * second}},
+			wantBuckets: byBucket([]int64{day + 10, day + 11}, nil, nil, nil),
+		},
+		{
+			name: "entirely before since",
+			lo:   day * second, hi: (day + 20) * second, since: day + 100,
+			wantScans: []nanoRange{seconds(day, day+20)},
+		},
+		{
+			name: "within a second",
+			lo:   day*second + 1, hi: day*second + 5, since: day,
+			wantScans: []nanoRange{{day*second + 1, day*second + 5}},
+		},
+		{
+			name: "partial seconds at both ends",
+			lo:   day*second + second/2, hi: (day+2)*second + second/4, since: day,
+			wantScans:   []nanoRange{{day*second + second/2, (day + 1) * second}, {(day + 2) * second, (day+2)*second + second/4}},
+			wantBuckets: byBucket([]int64{day + 1}, nil, nil, nil),
+		},
+		{
+			name: "whole minute",
+			lo:   day * second, hi: (day + 60) * second, since: day,
+			wantBuckets: byBucket(nil, []int64{day}, nil, nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scans, buckets := splitSummaryRange(tt.lo, tt.hi, tt.since, now)
+			if !reflect.DeepEqual(scans, tt.wantScans) {
+				t.Errorf("scans = %v, want %v", scans, tt.wantScans)
+			}
+			if !reflect.DeepEqual(buckets, tt.wantBuckets) {
+				t.Errorf("buckets = %v, want %v", buckets, tt.wantBuckets)
+			}
+		})
+	}
+}
+
+// Every nanosecond of the range must be counted exactly once, only from
+// buckets that were counted and have not expired.
+func TestSplitSummaryRangeCoversRangeOnce(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+
+	for range 5000 {
+		now := day + r.Int64N(30*24*60*60)
+		lo := (now-r.Int64N(40*24*60*60))*second + r.Int64N(second)
+		hi := lo + r.Int64N(10*24*60*60*second)
+		since := now - r.Int64N(50*24*60*60)
+
+		scans, buckets := splitSummaryRange(lo, hi, since, now)
+
+		var ranges []nanoRange
+		for _, scan := range scans {
+			if scan.from >= scan.to {
+				t.Fatalf("empty scan %v of [%d, %d)", scan, lo, hi)
+			}
+			ranges = append(ranges, scan)
+		}
+		for i, starts := range buckets {
+			bucket := summaryBuckets[i]
+			for _, start := range starts {
+				if start < since {
+					t.Fatalf("%s bucket %d read before since %d", bucket.name, start, since)
+				}
+				if bucket.shard != 0 && bucket.expireAt(start) < now+summaryShardMargin {
+					t.Fatalf("%s bucket %d read from a shard expiring at %d, now %d", bucket.name, start, bucket.expireAt(start), now)
+				}
+				ranges = append(ranges, seconds(start, start+bucket.width))
+			}
+		}
+
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i].from < ranges[j].from })
+		at := lo
+		for _, rng := range ranges {
+			if rng.from != at {
+				t.Fatalf("[%d, %d): gap or overlap at %d, next range starts at %d", lo, hi, at, rng.from)
+			}
+			at = rng.to
+		}
+		if hi > lo && at != hi {
+			t.Fatalf("[%d, %d): covered up to %d", lo, hi, at)
+		}
+	}
+}
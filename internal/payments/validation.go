@@ -0,0 +1,199 @@
+package payments
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const maxPaymentBodyBytes = 4 << 10
+
+type requestError struct {
+	status  int
+	code    string
+	message string
+	details []FieldError
+}
+
+func (e *requestError) write(w http.ResponseWriter) {
+	WriteError(w, e.status, e.code, e.message, e.details...)
+}
+
+// paymentRequest is the body of POST /payments. It only has the fields a
+// client may send, so that anything else, such as requestedAt, is rejected as
+// unknown instead of silently accepted. The amount is parsed by
+// validatePayment, which reports what is wrong with it.
+type paymentRequest struct {
+	CorrelationID string          `json:"correlationId"`
+	Amount        json.RawMessage `json:"amount"`
+}
+
+func decodePayment(w http.ResponseWriter, r *http.Request) (Payment, *requestError) {
+	var request paymentRequest
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPaymentBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&request); err != nil {
+		return Payment{}, decodeError(err)
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		return Payment{}, &requestError{
+			status:  http.StatusBadRequest,
+			code:    ErrCodeMalformedJSON,
+			message: "Request body must contain a single JSON object",
+		}
+	}
+
+	payment, details := validatePayment(request)
+	if len(details) > 0 {
+		return Payment{}, &requestError{
+			status:  http.StatusBadRequest,
+			code:    ErrCodeValidationFailed,
+			message: "Invalid payment",
+			details: details,
+		}
+	}
+
+	return payment, nil
+}
+
+func decodeError(err error) *requestError {
+	var maxBytesErr *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return &requestError{
+			status:  http.StatusRequestEntityTooLarge,
+			code:    ErrCodeBodyTooLarge,
+			message: "Request body is too large",
+		}
+	case errors.As(err, &typeErr):
+		return &requestError{
+			status:  http.StatusBadRequest,
+			code:    ErrCodeValidationFailed,
+			message: "Invalid payment",
+			details: []FieldError{{
+				Field:   typeErr.Field,
+				Code:    "invalid_type",
+				Message: "must be " + jsonTypeName(typeErr.Type.Kind()),
+			}},
+		}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return &requestError{
+			status:  http.StatusBadRequest,
+			code:    ErrCodeValidationFailed,
+			message: "Invalid payment",
+			details: []FieldError{{
+				Field:   field,
+				Code:    "unknown_field",
+				Message: "is not a known field",
+			}},
+		}
+	case errors.Is(err, io.EOF):
+		return &requestError{
+			status:  http.StatusBadRequest,
+			code:    ErrCodeMalformedJSON,
+			message: "Request body is empty",
+		}
+	default:
+		return &requestError{
+			status:  http.StatusBadRequest,
+			code:    ErrCodeMalformedJSON,
+			message: "Request body is not valid JSON",
+		}
+	}
+}
+
+func validatePayment(request paymentRequest) (Payment, []FieldError) {
+	var details []FieldError
+
+	payment := Payment{CorrelationID: request.CorrelationID}
+
+	switch {
+	case payment.CorrelationID == "":
+		details = append(details, FieldError{
+			Field:   "correlationId",
+			Code:    "required",
+			Message: "is required",
+		})
+	case !isUUID(payment.CorrelationID):
+		details = append(details, FieldError{
+			Field:   "correlationId",
+			Code:    "invalid_format",
+			Message: "must be a UUID",
+		})
+	}
+
+	// A missing or null amount is left at zero and reported as not positive.
+	var err error
+	if len(request.Amount) > 0 {
+		err = payment.Amount.UnmarshalJSON(request.Amount)
+	}
+
+	switch {
+	case errors.Is(err, ErrMoneyPrecision):
+		details = append(details, FieldError{
+			Field:   "amount",
+			Code:    "invalid_precision",
+			Message: "must have at most two decimal places",
+		})
+	case err != nil:
+		details = append(details, FieldError{
+			Field:   "amount",
+			Code:    "invalid_format",
+			Message: "must be a decimal number within range",
+		})
+	case payment.Amount <= 0:
+		details = append(details, FieldError{
+			Field:   "amount",
+			Code:    "must_be_positive",
+			Message: "must be greater than zero",
+		})
+	}
+
+	return payment, details
+}
+
+func jsonTypeName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return "a string"
+	case reflect.Float32, reflect.Float64, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "a representable number"
+	default:
+		return "a valid value"
+	}
+}
+
+func isUUID(value string) bool {
+	if len(value) != 36 {
+		return false
+	}
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !isHexDigit(c) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
@@ -0,0 +1,48 @@
+package payments
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidatePaymentAmount(t *testing.T) {
+	const correlationID = "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3"
+
+	tests := []struct {
+		amount string
+		want   Money
+		code   string
+	}{
+		{amount: "19.90", want: 1990},
+		{amount: "10.000", want: 1000},
+		{amount: "10.005", code: "invalid_precision"},
+		{amount: "0.004", code: "invalid_precision"},
+		{amount: "0", code: "must_be_positive"},
+		{amount: "-1", code: "must_be_positive"},
+		{amount: "null", code: "must_be_positive"},
+		{amount: "", code: "must_be_positive"},
+		{amount: `"19.90"`, code: "invalid_format"},
+		{amount: "1e30", code: "invalid_format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.amount, func(t *testing.T) {
+			request := paymentRequest{CorrelationID: correlationID, Amount: json.RawMessage(tt.amount)}
+
+			payment, details := validatePayment(request)
+			if tt.code == "" {
+				if len(details) > 0 {
+					t.Fatalf("validatePayment(%s) details = %v, want none", tt.amount, details)
+				}
+				if payment.Amount != tt.want {
+					t.Errorf("validatePayment(%s) amount = %d, want %d", tt.amount, payment.Amount, tt.want)
+				}
+				return
+			}
+
+			if len(details) != 1 || details[0].Field != "amount" || details[0].Code != tt.code {
+				t.Errorf("validatePayment(%s) details = %v, want amount %s", tt.amount, details, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/vrtineu/payments-proxy"
+
+// Span attributes shared by the ingestion and processing sides.
+const (
+	CorrelationIDKey = attribute.Key("payment.correlation_id")
+	GatewayKey       = attribute.Key("payment.gateway")
+	AttemptKey       = attribute.Key("payment.attempt")
+	MessageIDKey     = attribute.Key("messaging.message.id")
+)
+
+type Exporter int
+
+const (
+	// ExporterNone keeps propagating trace context without recording spans.
+	ExporterNone Exporter = iota
+	ExporterStdout
+	// ExporterOTLP sends spans over OTLP/HTTP, to Endpoint or to the standard
+	// OTEL_EXPORTER_OTLP_* environment variables when it is empty.
+	ExporterOTLP
+)
+
+func ParseExporter(value string) (Exporter, error) {
+	switch value {
+	case "", "none":
+		return ExporterNone, nil
+	case "stdout":
+		return ExporterStdout, nil
+	case "otlp":
+		return ExporterOTLP, nil
+	default:
+		return ExporterNone, fmt.Errorf("unknown trace exporter %q", value)
+	}
+}
+
+type Config struct {
+	Exporter    Exporter
+	Endpoint    string
+	ServiceName string
+	InstanceID  string
+	// SampleRatio is the fraction of new traces recorded; traces started
+	// upstream follow the caller's sampling decision.
+	SampleRatio float64
+}
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. The returned function flushes the spans still buffered.
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(config.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating trace exporter: %w", err)
+	}
+
+	resource, err := sdkresource.Merge(sdkresource.Default(), sdkresource.NewSchemaless(
+		semconv.ServiceName(config.ServiceName),
+		semconv.ServiceInstanceID(config.InstanceID),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("creating trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Carrier captures the trace context of ctx, to be written into the fields of
+// a stream entry or carried past the lifetime of ctx.
+func Carrier(ctx context.Context) propagation.MapCarrier {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// Extract restores the trace context captured by Carrier from the fields of a
+// stream entry.
+func Extract(ctx context.Context, values map[string]any) context.Context {
+	carrier := propagation.MapCarrier{}
+	for _, field := range otel.GetTextMapPropagator().Fields() {
+		if v, ok := values[field].(string); ok {
+			carrier[field] = v
+		}
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// Link points to the span whose context was captured in carrier.
+func Link(carrier propagation.MapCarrier) trace.Link {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), carrier)
+	return trace.LinkFromContext(ctx)
+}
+
+// RecordError marks the span as failed with err, if any.
+func RecordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// End records err, if any, on the span and ends it.
+func End(span trace.Span, err error) {
+	RecordError(span, err)
+	span.End()
+}